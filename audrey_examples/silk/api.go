@@ -0,0 +1,352 @@
+package silk
+
+import (
+    "fmt"
+    "reflect"
+    "strconv"
+    "strings"
+    "net/http"
+    "encoding/json"
+)
+
+// body of POST /api/tasks
+// Type is the name of a type passed to RegisterTaskType, e.g. "main.Count"
+type SubmitRequest struct {
+    Type string
+    Task json.RawMessage
+    Tenant string
+    Pool string
+    Priority int
+    IdempotencyKey string
+    Placement Placement
+}
+
+type SubmitResponse struct {
+    Id int
+}
+
+// response of GET /api/tasks/{id}
+type TaskDetail struct {
+    Status TaskStatus
+    Latest Task
+}
+
+// one line of GET /api/tasks/{id}/checkpoints
+type CheckpointMessage struct {
+    Type string
+    Checkpoint Task
+}
+
+// json api for submitting and inspecting tasks without writing go
+//   POST /api/tasks                  submit a task, see SubmitRequest
+//   GET  /api/tasks                  list tasks. ?pool=NAME for one pool's
+//   GET  /api/tasks/{id}             status and latest checkpoint
+//   GET  /api/tasks/{id}/checkpoints stream checkpoints, one json object per line
+//   GET  /api/tasks/{id}/result      how an ended task turned out, see TaskResult
+//   POST /api/tasks/{id}/cancel      cancel a task
+//   GET  /api/nodes                  list nodes. ?pool=NAME for one pool's
+//   POST /api/nodes/{id}/drain       stop giving a node new tasks
+//   POST /api/nodes/{id}/quarantine  stop giving a node's machine new tasks
+//   POST /api/nodes/{id}/release     lift a quarantine on a node's machine
+//   GET  /api/health                 per machine health scores
+//   GET  /api/tenants                per tenant usage, of ?pool=NAME or the
+//                                    default pool
+//   GET  /api/pools                  per pool settings and usage
+//   GET  /api/usage/{by}             resources used by tasks, tenants or nodes.
+//                                    ?format=csv for csv
+//   GET  /api/events                 recent events then live ones, one per line
+type apiHandler struct {
+    server *Server
+}
+
+func (self apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+
+    switch {
+    case len(path) == 1 && path[0] == "tasks" && r.Method == "POST":
+        self.submit(w, r)
+    case len(path) == 1 && path[0] == "tasks" && r.Method == "GET":
+        self.tasks(w, r)
+    case len(path) == 2 && path[0] == "tasks" && r.Method == "GET":
+        self.task(w, path[1])
+    case len(path) == 3 && path[0] == "tasks" && path[2] == "checkpoints" && r.Method == "GET":
+        self.checkpoints(w, r, path[1])
+    case len(path) == 3 && path[0] == "tasks" && path[2] == "result" && r.Method == "GET":
+        self.result(w, path[1])
+    case len(path) == 3 && path[0] == "tasks" && path[2] == "cancel" && r.Method == "POST":
+        self.cancel(w, path[1])
+    case len(path) == 1 && path[0] == "nodes" && r.Method == "GET":
+        self.nodes(w, r)
+    case len(path) == 3 && path[0] == "nodes" && path[2] == "drain" && r.Method == "POST":
+        self.nodeAction(w, path[1], self.server.DrainNode)
+    case len(path) == 3 && path[0] == "nodes" && path[2] == "quarantine" && r.Method == "POST":
+        self.nodeAction(w, path[1], self.server.QuarantineNode)
+    case len(path) == 3 && path[0] == "nodes" && path[2] == "release" && r.Method == "POST":
+        self.nodeAction(w, path[1], self.server.ReleaseNode)
+    case len(path) == 1 && path[0] == "health" && r.Method == "GET":
+        self.writeJson(w, self.server.Health())
+    case len(path) == 1 && path[0] == "tenants" && r.Method == "GET":
+        self.tenants(w, r)
+    case len(path) == 1 && path[0] == "pools" && r.Method == "GET":
+        self.writeJson(w, self.server.PoolUsage())
+    case len(path) == 2 && path[0] == "usage" && r.Method == "GET":
+        self.usage(w, r, path[1])
+    case len(path) == 1 && path[0] == "events" && r.Method == "GET":
+        self.tail(w, r)
+    default:
+        http.Error(w, "No such endpoint", 404)
+    }
+}
+
+func (self apiHandler) writeJson(w http.ResponseWriter, value interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    err := json.NewEncoder(w).Encode(value)
+    if err != nil {
+        self.server.log().Warn("could not write api response", "error", err)
+    }
+}
+
+func (self apiHandler) submit(w http.ResponseWriter, r *http.Request) {
+    var req SubmitRequest
+    err := json.NewDecoder(r.Body).Decode(&req)
+    if err != nil {
+        http.Error(w, "Could not decode SubmitRequest", 400)
+        return
+    }
+
+    taskTypesLock.Lock()
+    ty, ok := taskTypes[req.Type]
+    taskTypesLock.Unlock()
+    if !ok {
+        http.Error(w, fmt.Sprintf("Unknown task type %q", req.Type), 400)
+        return
+    }
+
+    // registered as either a value or a pointer
+    var value reflect.Value
+    if ty.Kind() == reflect.Ptr {
+        value = reflect.New(ty.Elem())
+        err = json.Unmarshal(req.Task, value.Interface())
+    } else {
+        ptr := reflect.New(ty)
+        err = json.Unmarshal(req.Task, ptr.Interface())
+        value = ptr.Elem()
+    }
+    if err != nil {
+        http.Error(w, fmt.Sprintf("Could not decode %s: %s", req.Type, err.Error()), 400)
+        return
+    }
+
+    task, ok := value.Interface().(Task)
+    if !ok {
+        http.Error(w, fmt.Sprintf("%s is not a Task", req.Type), 400)
+        return
+    }
+
+    sub, err := self.server.SubmitTaskWith(task, TaskOptions{
+        Tenant: req.Tenant,
+        Pool: req.Pool,
+        Priority: req.Priority,
+        IdempotencyKey: req.IdempotencyKey,
+        Placement: req.Placement,
+    })
+    if err == ErrOverloaded || err == ErrStandby {
+        http.Error(w, err.Error(), 503)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+
+    self.server.log().Info("task submitted over http", logTaskId, sub.Id, "type", req.Type, "tenant", req.Tenant, logRemoteAddr, r.RemoteAddr)
+    self.writeJson(w, SubmitResponse{sub.Id})
+}
+
+func (self apiHandler) tasks(w http.ResponseWriter, r *http.Request) {
+    tasks := self.server.Tasks()
+    if !r.URL.Query().Has("pool") {
+        self.writeJson(w, tasks)
+        return
+    }
+
+    pool := r.URL.Query().Get("pool")
+    result := []TaskStatus{}
+    for _, t := range tasks {
+        if t.Pool == pool {
+            result = append(result, t)
+        }
+    }
+    self.writeJson(w, result)
+}
+
+func (self apiHandler) nodes(w http.ResponseWriter, r *http.Request) {
+    nodes := self.server.Nodes()
+    if !r.URL.Query().Has("pool") {
+        self.writeJson(w, nodes)
+        return
+    }
+
+    pool := r.URL.Query().Get("pool")
+    result := []NodeStatus{}
+    for _, n := range nodes {
+        if n.Caps.Pool == pool {
+            result = append(result, n)
+        }
+    }
+    self.writeJson(w, result)
+}
+
+func (self apiHandler) tenants(w http.ResponseWriter, r *http.Request) {
+    usage, err := self.server.PoolTenantUsage(r.URL.Query().Get("pool"))
+    if err != nil {
+        http.Error(w, err.Error(), 404)
+        return
+    }
+    self.writeJson(w, usage)
+}
+
+func (self apiHandler) task(w http.ResponseWriter, idStr string) {
+    id, err := strconv.Atoi(idStr)
+    if err != nil {
+        http.Error(w, "Bad task id", 400)
+        return
+    }
+
+    status, latest, ok := self.server.TaskInfo(id)
+    if !ok {
+        http.Error(w, "No such task", 404)
+        return
+    }
+    self.writeJson(w, TaskDetail{status, latest})
+}
+
+func (self apiHandler) result(w http.ResponseWriter, idStr string) {
+    id, err := strconv.Atoi(idStr)
+    if err != nil {
+        http.Error(w, "Bad task id", 400)
+        return
+    }
+
+    result, ok, err := self.server.Result(id)
+    if err != nil {
+        http.Error(w, err.Error(), 500)
+        return
+    }
+    if !ok {
+        http.Error(w, "No result for task, it's still going or too old", 404)
+        return
+    }
+    self.writeJson(w, result)
+}
+
+func (self apiHandler) checkpoints(w http.ResponseWriter, r *http.Request, idStr string) {
+    id, err := strconv.Atoi(idStr)
+    if err != nil {
+        http.Error(w, "Bad task id", 400)
+        return
+    }
+
+    sub, err := self.server.Attach(id)
+    if err != nil {
+        http.Error(w, err.Error(), 404)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    flusher, _ := w.(http.Flusher)
+    e := json.NewEncoder(w)
+    for {
+        select {
+        case checkpoint, ok := <-sub.Checkpoints:
+            if !ok {
+                return
+            }
+            err = e.Encode(CheckpointMessage{fmt.Sprintf("%T", checkpoint), checkpoint})
+            if err != nil {
+                return
+            }
+            if flusher != nil {
+                flusher.Flush()
+            }
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+func (self apiHandler) cancel(w http.ResponseWriter, idStr string) {
+    id, err := strconv.Atoi(idStr)
+    if err != nil {
+        http.Error(w, "Bad task id", 400)
+        return
+    }
+
+    err = self.server.CancelTask(id)
+    if err != nil {
+        http.Error(w, err.Error(), 404)
+        return
+    }
+    self.writeJson(w, "ok")
+}
+
+func (self apiHandler) nodeAction(w http.ResponseWriter, idStr string, action func(int) error) {
+    id, err := strconv.Atoi(idStr)
+    if err != nil {
+        http.Error(w, "Bad node id", 400)
+        return
+    }
+
+    err = action(id)
+    if err != nil {
+        http.Error(w, err.Error(), 404)
+        return
+    }
+    self.writeJson(w, "ok")
+}
+
+func (self apiHandler) usage(w http.ResponseWriter, r *http.Request, by string) {
+    by = strings.TrimSuffix(by, "s")
+    rows, err := self.server.Usage(by)
+    if err != nil {
+        http.Error(w, err.Error(), 404)
+        return
+    }
+
+    if r.URL.Query().Get("format") == "csv" {
+        w.Header().Set("Content-Type", "text/csv")
+        err = WriteUsageCsv(w, by, rows)
+        if err != nil {
+            self.server.log().Warn("could not write api response", "error", err)
+        }
+        return
+    }
+    self.writeJson(w, rows)
+}
+
+func (self apiHandler) tail(w http.ResponseWriter, r *http.Request) {
+    recent, live, done := self.server.Events()
+    defer done()
+
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    flusher, _ := w.(http.Flusher)
+    e := json.NewEncoder(w)
+    for _, event := range recent {
+        if e.Encode(event) != nil {
+            return
+        }
+    }
+
+    for {
+        if flusher != nil {
+            flusher.Flush()
+        }
+        select {
+        case event := <-live:
+            if e.Encode(event) != nil {
+                return
+            }
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
@@ -0,0 +1,226 @@
+package silk
+
+import (
+    "sync"
+    "time"
+    "math/rand"
+    "net/http"
+)
+
+// faults to inject into a Server or Client, to check that rescheduling
+// copes. probabilities are per sync, except KillTask which is per checkpoint.
+// the same Seed makes the same decisions in the same order, though which
+// sync each decision lands on still depends on goroutine scheduling
+type Chaos struct {
+    Seed int64
+    DropSync float64 // client: the request is lost. server: the reply is
+    DelaySync float64 // by up to MaxDelay
+    MaxDelay time.Duration
+    CorruptSync float64 // cut the request or reply short, so it can't be decoded
+    StallSync float64 // client: go quiet for StallFor, e.g. past NodeTimeout
+    StallFor time.Duration
+    KillTask float64 // client: crash the running task, reported as a failure
+    RestartServer float64 // server: forget all nodes and take a new ServerId
+
+    lock sync.Mutex
+    rand *rand.Rand
+    faults map[string]int
+    pastServerIds map[int]bool
+    staleReports int
+}
+
+// counts of what Chaos did, and what the server made of it
+type ChaosStats struct {
+    Faults map[string]int // injected, by kind
+    StaleReports int // reports dropped since the node no longer had the task
+}
+
+// roll the dice for fault, which happens with probability p
+func (self *Chaos) roll(fault string, p float64) bool {
+    if p <= 0 {
+        return false
+    }
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if self.rand == nil {
+        self.rand = rand.New(rand.NewSource(self.Seed))
+        self.faults = make(map[string]int)
+        self.pastServerIds = make(map[int]bool)
+    }
+    if self.rand.Float64() >= p {
+        return false
+    }
+    self.faults[fault]++
+    return true
+}
+
+// a random duration up to max
+func (self *Chaos) upTo(max time.Duration) time.Duration {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if max <= 0 {
+        return 0
+    }
+    return time.Duration(self.rand.Int63n(int64(max)))
+}
+
+// a random length to cut a payload of size down to
+func (self *Chaos) cut(size int) int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if size <= 1 {
+        return 0
+    }
+    return self.rand.Intn(size - 1)
+}
+
+func (self *Chaos) restarted(serverId int) {
+    self.lock.Lock()
+    self.pastServerIds[serverId] = true
+    self.lock.Unlock()
+}
+
+// was this one of our ServerIds before a simulated restart
+func (self *Chaos) pastServer(serverId int) bool {
+    if self == nil {
+        return false
+    }
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.pastServerIds[serverId]
+}
+
+func (self *Chaos) staleReport() {
+    if self == nil {
+        return
+    }
+
+    self.lock.Lock()
+    self.staleReports++
+    self.lock.Unlock()
+}
+
+func (self *Chaos) Stats() ChaosStats {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    stats := ChaosStats{Faults: make(map[string]int), StaleReports: self.staleReports}
+    for fault, n := range self.faults {
+        stats.Faults[fault] = n
+    }
+    return stats
+}
+
+// faults on the way into ServeHTTP
+func (self *Server) chaosIn() {
+    if self.Chaos == nil {
+        return
+    }
+    if self.Chaos.roll("restart_server", self.Chaos.RestartServer) {
+        self.chaosRestart()
+    }
+    if self.Chaos.roll("delay_sync", self.Chaos.DelaySync) {
+        time.Sleep(self.Chaos.upTo(self.Chaos.MaxDelay))
+    }
+}
+
+// faults on the way out of ServeHTTP. returns false if the reply was lost
+func (self *Server) chaosOut(w http.ResponseWriter, reply []byte) ([]byte, bool) {
+    if self.Chaos == nil {
+        return reply, true
+    }
+    if self.Chaos.roll("corrupt_sync", self.Chaos.CorruptSync) {
+        reply = reply[:self.Chaos.cut(len(reply))]
+    }
+    if self.Chaos.roll("drop_sync", self.Chaos.DropSync) {
+        // hang up without a word, as if the network ate the reply
+        if hijacker, ok := w.(http.Hijacker); ok {
+            conn, _, err := hijacker.Hijack()
+            if err == nil {
+                conn.Close()
+                return reply, false
+            }
+        }
+        http.Error(w, "Dropped by chaos", 500)
+        return reply, false
+    }
+    return reply, true
+}
+
+// act as if the server went down and came back up with the same tasks: all
+// nodes are forgotten and their tasks requeued, and we take a new ServerId.
+// reports from nodes which still know the old one are dropped
+func (self *Server) chaosRestart() {
+    self.haLock.Lock()
+    old := self.ServerId
+    self.ServerId = int(time.Now().UnixNano())
+    self.haLock.Unlock()
+    self.announceChanged()
+    self.Chaos.restarted(old)
+    self.log().Warn("chaos: simulating server restart", "new_server_id", self.currentServerId())
+
+    self.nodeLock.Lock()
+    nodes := self.nodes
+    self.forgetNodes()
+    self.nodeLock.Unlock()
+
+    for id, node := range nodes {
+        self.nodeLost(id, node.TaskId)
+    }
+}
+
+// faults on the way into Client.post. returns false if the request was lost
+func (self *Client) chaosOut(body []byte) ([]byte, bool) {
+    if self.Chaos == nil {
+        return body, true
+    }
+    if self.Chaos.roll("stall_sync", self.Chaos.StallSync) {
+        self.log.Warn("chaos: stalling", logNodeId, self.Caps.NodeId, "for", self.Chaos.StallFor)
+        time.Sleep(self.Chaos.StallFor)
+    }
+    if self.Chaos.roll("delay_sync", self.Chaos.DelaySync) {
+        time.Sleep(self.Chaos.upTo(self.Chaos.MaxDelay))
+    }
+    if self.Chaos.roll("corrupt_sync", self.Chaos.CorruptSync) {
+        body = body[:self.Chaos.cut(len(body))]
+    }
+    if self.Chaos.roll("drop_sync", self.Chaos.DropSync) {
+        return body, false
+    }
+    return body, true
+}
+
+// stand between a task and the client, crashing it at random checkpoints
+func (self *Client) chaosKill(progress chan Task, failed chan string, cancel chan bool) (chan Task, chan bool) {
+    innerProgress := make(chan Task)
+    innerCancel := make(chan bool)
+
+    go func() {
+        defer close(innerCancel)
+        for {
+            select {
+            case t := <-innerProgress:
+                if !t.IsDone() && self.Chaos.roll("kill_task", self.Chaos.KillTask) {
+                    // the deferred close kills the task
+                    failed <- "killed by chaos"
+                    return
+                }
+                select {
+                case progress <- t:
+                case <-cancel:
+                    return
+                }
+            case <-cancel:
+                return
+            }
+        }
+    }()
+
+    return innerProgress, innerCancel
+}
@@ -4,6 +4,9 @@ import (
     "fmt"
     "time"
     "bytes"
+    "errors"
+    "math/rand"
+    "net/http"
     "io/ioutil"
     "encoding/gob"
 )
@@ -32,92 +35,344 @@ func (self *Client) Run() (int, error) {
         self.Caps.NodeId = -1
     }
 
+    if self.Caps.Identity == "" && self.IdentityFile != "" {
+        identity, err := loadIdentity(self.IdentityFile)
+        if err != nil {
+            return 0, clientError{"Couldn't load node identity", err}
+        }
+        self.Caps.Identity = identity
+    }
+
     self.serverId = -1
+    self.log = loggerOrDefault(self.Logger)
 
-    t, v, err := self.sync(nil)
-    if err != nil {
-        return v, err
+    if self.RetryBackoff == 0 {
+        self.RetryBackoff = time.Duration(time.Second)
+    }
+    if self.MaxRetryBackoff == 0 {
+        self.MaxRetryBackoff = time.Duration(time.Minute)
+    }
+    if self.Heartbeat == 0 {
+        self.Heartbeat = time.Duration(30 * time.Second)
     }
 
-    cancel := make(chan bool)
-    progress := make(chan Task)
-    go t.Run(progress, cancel)
+    if self.Discover != "" {
+        discovery, err := self.discover()
+        if err != nil {
+            return 0, clientError{"Couldn't listen for server announcements", err}
+        }
+        self.discovery = discovery
+        defer func() {
+            discovery.close()
+            self.discovery = nil
+        }()
+    }
 
-    for {
-        select {
-        case newt := <-progress:
-            t, v, err = self.sync(newt)
-        case <-time.After(time.Duration(30 * time.Second)):
-            t, v, err = self.sync(nil)
+    // cur.Task is always the latest checkpoint of the task we're working on
+    cur := taskWithId{-1, nil}
+    var progress chan Task
+    var failed chan string
+    var cancel chan bool
+    var run *Span
+
+    // while we can't reach a server the task keeps going. its latest
+    // checkpoint or failure is held on to until we can report it
+    pending := false
+    failure := ""
+    var retry <-chan time.Time // nil while connected
+    var lost time.Time
+    var backoff time.Duration
+
+    // end the span of the task we're running, if any
+    endRun := func(outcome string) {
+        run.set("outcome", outcome)
+        _, total := self.meter.unreported()
+        run.set("cpu_seconds", fmt.Sprintf("%.3f", total.Cpu.Seconds()))
+        run.set("peak_rss_kb", fmt.Sprint(total.PeakRSSKB))
+        run.finish(self.SpanExporter)
+        run = nil
+        self.trace = TraceContext{}
+    }
+
+    // sync, then either act on the response or schedule a retry. only
+    // returns an error once we've given up on the server
+    report := func(t taskWithId, reason string) (int, error) {
+        // checkpoints and failures carry what the task used since the last one
+        var total ResourceUsage
+        self.usage = ResourceUsage{}
+        if t.Task != nil {
+            self.usage, total = self.meter.unreported()
         }
 
+        next, v, err := self.sync(t, reason)
         if err != nil {
-            cancel <- true
-            return v, err
+            if v != 0 {
+                // must upgrade, retrying won't help
+                return v, err
+            }
+            if lost.IsZero() {
+                lost = time.Now()
+                backoff = self.RetryBackoff
+                self.log.Warn("lost server, retrying", logServerId, self.serverId, logNodeId, self.Caps.NodeId, logTaskId, cur.TaskId, "error", err)
+            } else {
+                backoff *= 2
+                if backoff > self.MaxRetryBackoff {
+                    backoff = self.MaxRetryBackoff
+                }
+            }
+            if self.GiveUpAfter > 0 && time.Since(lost) > self.GiveUpAfter {
+                return v, err
+            }
+
+            // somewhere between half and all of backoff, so a fleet of
+            // nodes doesn't come back all at once
+            wait := backoff / 2 + time.Duration(rand.Int63n(int64(backoff / 2) + 1))
+            self.log.Debug("retrying sync", "in", wait, "error", err)
+            retry = time.After(wait)
+            return 0, nil
+        }
+
+        if !lost.IsZero() {
+            self.log.Info("reconnected", logServerId, self.serverId, logNodeId, self.Caps.NodeId, "after", time.Since(lost))
+        }
+        lost = time.Time{}
+        retry = nil
+        if t.Task != nil {
+            pending = false
+            self.meter.reported(total)
+            self.log.Debug("reported usage", logNodeId, self.Caps.NodeId, logTaskId, t.TaskId, "cpu", self.usage.Cpu, "wall", self.usage.Wall, "peak_rss_kb", self.usage.PeakRSSKB)
         }
+        failure = ""
+
+        if next.Task != nil || next.TaskId != cur.TaskId {
+            // either new work or the old task was taken away from us
+            if cancel != nil {
+                close(cancel)
+                if cur.Task == nil || !cur.Task.IsDone() {
+                    self.log.Info("task taken away", logNodeId, self.Caps.NodeId, logTaskId, cur.TaskId)
+                }
+            }
+            if run != nil {
+                endRun("taken away")
+            }
+            cur = next
+            progress, failed, cancel = nil, nil, nil
+            self.meter = nil
+            if cur.Task != nil {
+                self.log.Info("starting task", logNodeId, self.Caps.NodeId, logTaskId, cur.TaskId, "isolated", self.Isolate)
+                run = startSpan(self.dispatchTrace, "run", "node_id", fmt.Sprint(self.Caps.NodeId), "task_id", fmt.Sprint(cur.TaskId))
+                self.trace = run.context()
+                progress, failed, cancel = self.launch(cur.Task)
+            }
+        }
+        return 0, nil
+    }
+
+    v, err := report(cur, "")
 
-        if t != nil {
-            cancel <- true
-            cancel = make(chan bool)
-            progress = make(chan Task)
-            go t.Run(progress, cancel)
+    for err == nil {
+        var heartbeat <-chan time.Time
+        if retry == nil {
+            heartbeat = time.After(self.Heartbeat)
         }
+
+        select {
+        case newt := <-progress:
+            cur.Task = newt
+            pending = true
+            if newt.IsDone() {
+                // before reporting, which may hand us the next task
+                self.log.Info("task finished", logNodeId, self.Caps.NodeId, logTaskId, cur.TaskId)
+                endRun("done")
+            } else {
+                self.log.Debug("checkpoint", logNodeId, self.Caps.NodeId, logTaskId, cur.TaskId)
+            }
+            if retry == nil {
+                v, err = report(cur, "")
+            }
+        case reason := <-failed:
+            self.log.Warn("task failed", logNodeId, self.Caps.NodeId, logTaskId, cur.TaskId, "reason", reason)
+            pending = true
+            failure = reason
+            endRun("failed")
+            if retry == nil {
+                v, err = report(cur, failure)
+            }
+        case <-retry:
+            if pending {
+                v, err = report(cur, failure)
+            } else {
+                v, err = report(taskWithId{cur.TaskId, nil}, "")
+            }
+        case <-heartbeat:
+            v, err = report(taskWithId{cur.TaskId, nil}, "")
+        }
+    }
+
+    if cancel != nil {
+        close(cancel)
+    }
+    if run != nil {
+        endRun("lost server")
+    }
+    self.log.Error("giving up on server", logServerId, self.serverId, logNodeId, self.Caps.NodeId, logTaskId, cur.TaskId, "error", err)
+    return v, err
+}
+
+// start working on a task, either in a goroutine or an isolated child process
+func (self *Client) launch(t Task) (chan Task, chan string, chan bool) {
+    progress := make(chan Task)
+    failed := make(chan string, 1)
+    cancel := make(chan bool)
+
+    self.meter = newTaskMeter(self.Isolate)
+
+    // what the task itself talks to, which chaos may come between
+    taskProgress, taskCancel := progress, cancel
+    if self.Chaos != nil {
+        taskProgress, taskCancel = self.chaosKill(progress, failed, cancel)
+    }
+
+    if self.Isolate {
+        go self.runIsolated(t, self.meter, taskProgress, failed, taskCancel)
+    } else {
+        go t.Run(taskProgress, taskCancel)
     }
+    return progress, failed, cancel
 }
 
-func (self *Client) sync(oldTask Task) (Task, int, error) {
+func (self *Client) sync(oldTask taskWithId, failure string) (taskWithId, int, error) {
     var sync SyncResponse
     var err error
 
     buf := bytes.Buffer{}
     e := gob.NewEncoder(&buf)
 
-    err = e.Encode(&SyncRequest{self.Version, self.serverId, self.Caps})
+    err = e.Encode(&SyncRequest{self.Version, self.serverId, self.Caps, failure, self.trace, self.usage, progressOf(oldTask.Task), self.term})
     if err != nil {
-        return nil, 0, clientError{"Couldn't encode SyncRequest", err}
+        return oldTask, 0, clientError{"Couldn't encode SyncRequest", err}
     }
 
-    if oldTask != nil || self.Caps.NodeId != -1 {
+    if self.Caps.NodeId != -1 {
         err = e.Encode(&oldTask)
         if err != nil {
-            return nil, 0, clientError{"Couldn't encode task", err}
+            return oldTask, 0, clientError{"Couldn't encode task", err}
         }
     }
 
-    url := fmt.Sprintf("http://%s:%d/sync", self.ServerDomain, self.ServerPort)
-    resp, err := self.netClient.Post(url, "application/octet-stream", &buf)
+    resp, err := self.post(buf.Bytes())
     if err != nil {
-        return nil, 0, clientError{"Sync transport failed", err}
+        return oldTask, 0, clientError{"Sync transport failed", err}
     }
+    defer resp.Body.Close()
 
     if resp.StatusCode >= 400 {
         body, err := ioutil.ReadAll(resp.Body)
         if err != nil {
-            return nil, 0, clientError{fmt.Sprintf("Sync failed with HTTP %d: [body undecodable: %s]", resp.StatusCode, err.Error()), nil}
+            return oldTask, 0, clientError{fmt.Sprintf("Sync failed with HTTP %d: [body undecodable: %s]", resp.StatusCode, err.Error()), nil}
         } else {
-            return nil, 0, clientError{fmt.Sprintf("Sync failed with HTTP %d: %s", resp.StatusCode, string(body)), nil}
+            return oldTask, 0, clientError{fmt.Sprintf("Sync failed with HTTP %d: %s", resp.StatusCode, string(body)), nil}
         }
     }
 
     d := gob.NewDecoder(resp.Body)
     err = d.Decode(&sync)
     if err != nil {
-        return nil, 0, clientError{"Couldn't decode SyncResponse", err}
+        return oldTask, 0, clientError{"Couldn't decode SyncResponse", err}
     }
 
     if sync.Version != self.Version {
-        return nil, sync.Version, clientError{"Must upgrade!", nil}
+        return oldTask, sync.Version, clientError{"Must upgrade!", nil}
     }
 
+    if sync.ServerId == self.serverId && sync.Term < self.term {
+        // a server which was taken over from and doesn't know it yet. what
+        // it says goes for nothing, try the one which took over
+        self.skipServer()
+        return oldTask, 0, clientError{fmt.Sprintf("Server is stale, term %d, we've seen %d", sync.Term, self.term), nil}
+    }
+    if sync.ServerId != self.serverId || sync.NodeId != self.Caps.NodeId {
+        self.log.Info("joined server", logServerId, sync.ServerId, logNodeId, sync.NodeId, "old_server_id", self.serverId, "old_node_id", self.Caps.NodeId)
+    }
+    if sync.ServerId != self.serverId || sync.Term > self.term {
+        self.term = sync.Term
+    }
     self.serverId = sync.ServerId
     self.Caps.NodeId = sync.NodeId
+    self.dispatchTrace = sync.Trace
 
-    var newTask Task
+    var newTask taskWithId
     err = d.Decode(&newTask)
     if err != nil {
-        return nil, 0, clientError{"Couldn't decode response task", err}
+        return oldTask, 0, clientError{"Couldn't decode response task", err}
     }
 
-    resp.Body.Close()
     return newTask, 0, nil
 }
+
+// the servers to sync with, in the order they're tried
+func (self *Client) addrs() []string {
+    var addrs []string
+    if self.ServerDomain != "" {
+        addrs = append(addrs, fmt.Sprintf("%s:%d", self.ServerDomain, self.ServerPort))
+    }
+    addrs = append(addrs, self.ServerAddrs...)
+    if self.discovery != nil {
+        addrs = append(addrs, self.discovery.addrs(self.serverId)...)
+    }
+    return addrs
+}
+
+// where the server we're talking to is in addrs, 0 if it isn't there. the
+// discovered ones come and go, so it's looked up by address every time
+func (self *Client) serverIndex(addrs []string) int {
+    for i, addr := range addrs {
+        if addr == self.server {
+            return i
+        }
+    }
+    return 0
+}
+
+// move on from the server we're talking to
+func (self *Client) skipServer() {
+    addrs := self.addrs()
+    if len(addrs) > 0 {
+        self.server = addrs[(self.serverIndex(addrs) + 1) % len(addrs)]
+    }
+}
+
+// POST to the server we're talking to. if it's unreachable or standing by
+// move on to the next one, trying each once, and stick with whichever
+// answers. standbys take over under the same ServerId, so the node and its
+// task carry on as if nothing happened
+func (self *Client) post(body []byte) (*http.Response, error) {
+    addrs := self.addrs()
+    if len(addrs) == 0 {
+        return nil, errors.New("no servers to sync with")
+    }
+
+    body, ok := self.chaosOut(body)
+    if !ok {
+        return nil, errors.New("request dropped by chaos")
+    }
+
+    var err error
+    start := self.serverIndex(addrs)
+    for i := range addrs {
+        var resp *http.Response
+        addr := addrs[(start + i) % len(addrs)]
+        resp, err = self.netClient.Post("http://" + addr + "/sync", "application/octet-stream", bytes.NewReader(body))
+        if len(addrs) == 1 || (err == nil && resp.StatusCode != 503) {
+            self.server = addr
+            return resp, err
+        }
+
+        if err == nil {
+            resp.Body.Close()
+            err = fmt.Errorf("%s is standing by", addr)
+        }
+        self.log.Debug("server unavailable, trying the next", "server", addr, "error", err)
+    }
+    return nil, err
+}
@@ -0,0 +1,131 @@
+package silk
+
+import (
+    "fmt"
+    "time"
+    "strings"
+    "strconv"
+)
+
+// a parsed five field cron expression: minute hour day-of-month month day-of-week
+// supports *, numbers, ranges (a-b), lists (a,b) and steps (*/n, a-b/n)
+type cronExpr struct {
+    minute, hour, dom, month, dow uint64 // bitsets
+    domStar, dowStar bool
+}
+
+func parseCron(expr string) (cronExpr, error) {
+    var c cronExpr
+    var err error
+
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return c, fmt.Errorf("cron expression %q must have 5 fields", expr)
+    }
+
+    if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+        return c, err
+    }
+    if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+        return c, err
+    }
+    if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+        return c, err
+    }
+    if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+        return c, err
+    }
+    if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+        return c, err
+    }
+    // sunday is both 0 and 7
+    if c.dow & (1 << 7) != 0 {
+        c.dow |= 1
+    }
+    // like cron, a field starting with * (e.g. */2) doesn't restrict the day,
+    // so the other day field has to match too
+    c.domStar = strings.HasPrefix(fields[2], "*")
+    c.dowStar = strings.HasPrefix(fields[4], "*")
+    return c, nil
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+    var bits uint64
+
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        if i := strings.Index(part, "/"); i != -1 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n <= 0 {
+                return 0, fmt.Errorf("bad cron step in %q", part)
+            }
+            step = n
+            part = part[:i]
+        }
+
+        lo, hi := min, max
+        if part != "*" {
+            bounds := strings.SplitN(part, "-", 2)
+            n, err := strconv.Atoi(bounds[0])
+            if err != nil {
+                return 0, fmt.Errorf("bad cron value in %q", part)
+            }
+            lo, hi = n, n
+            if len(bounds) == 2 {
+                hi, err = strconv.Atoi(bounds[1])
+                if err != nil {
+                    return 0, fmt.Errorf("bad cron range in %q", part)
+                }
+            } else if step != 1 {
+                // "5/15" means starting at 5
+                hi = max
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("cron value out of range in %q", part)
+        }
+
+        for i := lo; i <= hi; i += step {
+            bits |= 1 << uint(i)
+        }
+    }
+    return bits, nil
+}
+
+func (self cronExpr) matchesDay(t time.Time) bool {
+    dom := self.dom & (1 << uint(t.Day())) != 0
+    dow := self.dow & (1 << uint(t.Weekday())) != 0
+    if self.domStar || self.dowStar {
+        return dom && dow
+    }
+    // if both are restricted, either may match
+    return dom || dow
+}
+
+// the first matching minute strictly after t
+func (self cronExpr) next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+
+    for t.Before(limit) {
+        if self.month & (1 << uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if !self.matchesDay(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if self.hour & (1 << uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, t.Location())
+            continue
+        }
+        if self.minute & (1 << uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    // unsatisfiable, e.g. february 31st
+    return time.Time{}
+}
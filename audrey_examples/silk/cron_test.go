@@ -0,0 +1,36 @@
+package silk
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCronNext(t *testing.T) {
+    // 2024-01-01 is a monday
+    after := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    cases := []struct {
+        expr string
+        want time.Time
+    }{
+        {"*/15 * * * *", time.Date(2024, 1, 1, 0, 15, 0, 0, time.UTC)},
+        {"30 9 * * 1-5", time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC)},
+        // both days restricted: either may match
+        {"0 0 1 * 1", time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)},
+        // */2 doesn't restrict the day of month, so it has to be an odd day
+        // and a monday
+        {"0 0 */2 * 1", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+        {"0 0 * * */3", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+        {"0 0 31 2 *", time.Time{}},
+    }
+
+    for _, c := range cases {
+        expr, err := parseCron(c.expr)
+        if err != nil {
+            t.Fatalf("parseCron(%q): %v", c.expr, err)
+        }
+        got := expr.next(after)
+        if !got.Equal(c.want) {
+            t.Errorf("next(%q) = %v, want %v", c.expr, got, c.want)
+        }
+    }
+}
@@ -0,0 +1,307 @@
+package silk
+
+import (
+    "sync"
+    "time"
+    "net/http"
+    "encoding/json"
+)
+
+// how often the dashboard is refreshed and queue depth is sampled
+const dashboardInterval = time.Second
+
+// how many queue depth samples are kept, i.e. five minutes worth
+const depthHistory = 300
+
+type DepthSample struct {
+    Time time.Time
+    Depth int
+}
+
+// everything the dashboard shows, sent as one server-sent event per second
+type DashboardSnapshot struct {
+    Time time.Time
+    Nodes []NodeStatus
+    Tasks []TaskStatus // queued and running only
+    Pools []PoolStatus // each with its tenants
+    Depth []DepthSample
+    Trouble []Event // recent failures, reschedules, node timeouts and quarantines
+}
+
+type depthSampler struct {
+    lock sync.Mutex
+    samples []DepthSample
+}
+
+// runs for the life of the server
+func (self *Server) sampleQueueDepth() {
+    for {
+        depth := 0
+        for _, pool := range self.pools {
+            depth += pool.queue.depth()
+        }
+        sample := DepthSample{time.Now(), depth}
+
+        self.depth.lock.Lock()
+        self.depth.samples = append(self.depth.samples, sample)
+        if len(self.depth.samples) > depthHistory {
+            self.depth.samples = self.depth.samples[len(self.depth.samples) - depthHistory:]
+        }
+        self.depth.lock.Unlock()
+
+        time.Sleep(dashboardInterval)
+    }
+}
+
+func (self *Server) dashboardSnapshot() DashboardSnapshot {
+    snapshot := DashboardSnapshot{
+        Time: time.Now(),
+        Nodes: self.Nodes(),
+        Pools: self.PoolUsage(),
+        Trouble: self.events.last(50, EventTaskFailed, EventTaskRescheduled, EventNodeTimeout, EventNodeQuarantined),
+    }
+
+    for _, t := range self.Tasks() {
+        if t.State == TaskQueued || t.State == TaskRunning {
+            snapshot.Tasks = append(snapshot.Tasks, t)
+        }
+    }
+
+    self.depth.lock.Lock()
+    snapshot.Depth = append([]DepthSample{}, self.depth.samples...)
+    self.depth.lock.Unlock()
+
+    return snapshot
+}
+
+// GET /dashboard serves the page, GET /dashboard/events feeds it
+type dashboardHandler struct {
+    server *Server
+}
+
+func (self dashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        http.Error(w, "Bad method - must only GET the dashboard", 400)
+        return
+    }
+
+    switch r.URL.Path {
+    case "/dashboard", "/dashboard/":
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Write([]byte(dashboardPage))
+    case "/dashboard/events":
+        self.feed(w, r)
+    default:
+        http.Error(w, "No such page", 404)
+    }
+}
+
+func (self dashboardHandler) feed(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "Streaming unsupported", 500)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    _, live, done := self.server.Events()
+    defer done()
+
+    send := func(kind string, value interface{}) bool {
+        data, err := json.Marshal(value)
+        if err != nil {
+            return false
+        }
+        _, err = w.Write([]byte("event: " + kind + "\ndata: " + string(data) + "\n\n"))
+        if err != nil {
+            return false
+        }
+        flusher.Flush()
+        return true
+    }
+
+    ticker := time.NewTicker(dashboardInterval)
+    defer ticker.Stop()
+
+    if !send("snapshot", self.server.dashboardSnapshot()) {
+        return
+    }
+    for {
+        select {
+        case <-ticker.C:
+            if !send("snapshot", self.server.dashboardSnapshot()) {
+                return
+            }
+        case event := <-live:
+            if !send("event", event) {
+                return
+            }
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>silk</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+h2 { margin-top: 1.5em; font-size: 1.1em; }
+table { border-collapse: collapse; font-size: 0.9em; }
+th, td { text-align: left; padding: 2px 12px 2px 0; }
+th { border-bottom: 1px solid #999; }
+.dim { color: #888; }
+.bad { color: #b00; }
+.bar { display: inline-block; height: 8px; background: #48c; }
+#status { float: right; }
+#log { font-family: monospace; font-size: 0.85em; max-height: 15em; overflow-y: auto; }
+</style>
+</head>
+<body>
+<span id="status" class="dim">connecting...</span>
+<h1>silk</h1>
+
+<h2>Queue depth</h2>
+<svg id="depth" width="600" height="80"></svg>
+<div id="depthNow" class="dim"></div>
+
+<h2>Nodes</h2>
+<table id="nodes"></table>
+
+<h2>Tasks</h2>
+<table id="tasks"></table>
+
+<h2>Tenants</h2>
+<table id="tenants"></table>
+
+<h2>Recent failures and reschedules</h2>
+<table id="trouble"></table>
+
+<h2>Live events</h2>
+<div id="log"></div>
+
+<script>
+function esc(s) {
+    return String(s).replace(/[&<>"]/g, function(c) {
+        return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+    });
+}
+
+function id(n) {
+    return n == -1 ? "-" : n;
+}
+
+function age(t, now) {
+    if (t.startsWith("0001")) return "never";
+    var s = (new Date(now) - new Date(t)) / 1000;
+    return s < 60 ? s.toFixed(1) + "s" : (s / 60).toFixed(1) + "m";
+}
+
+function table(el, head, rows) {
+    var html = "<tr>" + head.map(function(h) { return "<th>" + h + "</th>"; }).join("") + "</tr>";
+    rows.forEach(function(r) {
+        html += "<tr>" + r.join("") + "</tr>";
+    });
+    document.getElementById(el).innerHTML = html;
+}
+
+function labels(m) {
+    return Object.keys(m || {}).sort().map(function(k) { return k + "=" + m[k]; }).join(", ");
+}
+
+function td(value, cls) {
+    return "<td" + (cls ? " class=\"" + cls + "\"" : "") + ">" + value + "</td>";
+}
+
+function progress(p) {
+    if (!p) return "";
+    var s = p.Fraction >= 0 ? (100 * p.Fraction).toFixed(0) + "%" : "";
+    return esc([s, p.Stage].join(" "));
+}
+
+function eta(t, now) {
+    if (t.startsWith("0001")) return "";
+    var s = (new Date(t) - new Date(now)) / 1000;
+    if (s <= 0) return "any moment";
+    return "in " + (s < 60 ? s.toFixed(0) + "s" : (s / 60).toFixed(1) + "m");
+}
+
+function depth(samples) {
+    var svg = document.getElementById("depth");
+    var w = svg.width.baseVal.value, h = svg.height.baseVal.value;
+    var max = 1;
+    samples.forEach(function(s) { max = Math.max(max, s.Depth); });
+    var points = samples.map(function(s, i) {
+        return (i * w / 300).toFixed(1) + "," + (h - 2 - s.Depth * (h - 4) / max).toFixed(1);
+    });
+    svg.innerHTML = "<polyline fill=\"none\" stroke=\"#48c\" stroke-width=\"1.5\" points=\"" + points.join(" ") + "\"/>";
+    var now = samples.length ? samples[samples.length - 1].Depth : 0;
+    document.getElementById("depthNow").textContent = now + " queued now, peak " + max + " in the last " + samples.length + "s";
+}
+
+function render(s) {
+    depth(s.Depth || []);
+
+    table("nodes", ["id", "addr", "sites", "mem MB", "cpus", "lifetime", "labels", "task", "last seen", ""],
+        (s.Nodes || []).map(function(n) {
+            return [td(n.Id), td(esc(n.Addr)), td(n.Caps.CapSites), td(n.Caps.CapMemMB), td(n.Caps.CapCpus),
+                td(n.Caps.CapLifetime / 1e9 + "s"), td(esc(labels(n.Caps.Labels)), "dim"), td(id(n.TaskId)), td(age(n.LastSeen, s.Time) + " ago", "dim"),
+                td([n.Draining ? "draining" : "", n.Quarantined ? "quarantined" : ""].join(" "), "dim")];
+        }));
+
+    var most = 1;
+    (s.Tasks || []).forEach(function(t) { most = Math.max(most, t.Checkpoints); });
+    table("tasks", ["id", "type", "tenant", "state", "node", "checkpoints", "last checkpoint", "progress", "eta"],
+        (s.Tasks || []).map(function(t) {
+            var bar = "<span class=\"bar\" style=\"width:" + (60 * t.Checkpoints / most) + "px\"></span> " + t.Checkpoints;
+            return [td(t.Id), td(esc(t.Type)), td(esc(t.Tenant)), td(t.State), td(id(t.NodeId)), td(bar),
+                td(age(t.LastCheckpoint, s.Time) + (t.LastCheckpoint.startsWith("0001") ? "" : " ago"), "dim"),
+                td(progress(t.Progress)), td(t.State == "running" ? eta(t.ETA, s.Time) : "", "dim")];
+        }));
+
+    var tenants = [];
+    (s.Pools || []).forEach(function(p) {
+        Object.keys(p.Tenants || {}).sort().forEach(function(name) {
+            var u = p.Tenants[name];
+            tenants.push([td(esc(p.Name || "(default)")), td(esc(name || "(default)")), td(u.Weight), td(u.MaxRunning || "-"),
+                td(u.Queued), td(u.Running), td(u.Submitted), td(u.Finished)]);
+        });
+    });
+    table("tenants", ["pool", "tenant", "weight", "max running", "queued", "running", "submitted", "finished"], tenants);
+
+    table("trouble", ["when", "what", "node", "task", ""],
+        (s.Trouble || []).slice().reverse().map(function(e) {
+            return [td(age(e.Time, s.Time) + " ago", "dim"), td(e.Kind, "bad"), td(id(e.NodeId)), td(id(e.TaskId)), td(esc(e.Message))];
+        }));
+}
+
+function connect() {
+    var source = new EventSource("/dashboard/events");
+    var status = document.getElementById("status");
+    source.addEventListener("snapshot", function(msg) {
+        status.textContent = "live";
+        render(JSON.parse(msg.data));
+    });
+    source.addEventListener("event", function(msg) {
+        var e = JSON.parse(msg.data);
+        var log = document.getElementById("log");
+        var line = document.createElement("div");
+        line.textContent = e.Time.substr(11, 12) + " " + e.Kind + " node=" + id(e.NodeId) + " task=" + id(e.TaskId) + " " + e.Message;
+        log.insertBefore(line, log.firstChild);
+        while (log.childNodes.length > 200) log.removeChild(log.lastChild);
+    });
+    source.onerror = function() {
+        status.textContent = "disconnected, retrying...";
+    };
+}
+
+connect();
+</script>
+</body>
+</html>
+`
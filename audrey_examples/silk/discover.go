@@ -0,0 +1,221 @@
+package silk
+
+import (
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "bytes"
+    "context"
+    "strconv"
+    "encoding/gob"
+)
+
+// servers announce themselves every announceInterval at first, then less
+// and less often up to maxAnnounceInterval, until what they announce changes.
+// clients forget a server after missing announceMisses of its announcements
+const announceInterval = time.Second
+const maxAnnounceInterval = 30 * time.Second
+const announceMisses = 3
+
+// one UDP datagram sent by a server with Announce set
+type announcement struct {
+    Version int
+    PoolVersions []int // of pools whose Version differs
+    ServerId int
+    Addr string // "host:port" to sync with, empty if the client should use the sender's address
+    Port int
+    Standby bool
+    Next time.Duration // until the server announces again
+}
+
+// runs for the life of the server
+func (self *Server) announce() {
+    dest, err := net.ResolveUDPAddr("udp", self.Announce)
+    if err != nil {
+        self.log().Error("bad announce address", "announce", self.Announce, "error", err)
+        return
+    }
+
+    config := net.ListenConfig{Control: allowBroadcast}
+    conn, err := config.ListenPacket(context.Background(), "udp", ":0")
+    if err != nil {
+        self.log().Error("could not open announce socket", "error", err)
+        return
+    }
+    defer conn.Close()
+
+    // listening on all interfaces means the client has to fill in our host
+    host, portStr, _ := net.SplitHostPort(self.Listen)
+    port, _ := strconv.Atoi(portStr)
+    addr := ""
+    if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+        addr = self.Listen
+    }
+
+    interval := announceInterval
+    timer := time.NewTimer(interval)
+    defer timer.Stop()
+
+    for {
+        self.haLock.Lock()
+        msg := announcement{self.Version, self.poolVersions(), self.ServerId, addr, port, !self.active, interval}
+        self.haLock.Unlock()
+
+        buf := bytes.Buffer{}
+        err = gob.NewEncoder(&buf).Encode(&msg)
+        if err == nil {
+            _, err = conn.WriteTo(buf.Bytes(), dest)
+        }
+        if err != nil {
+            self.log().Warn("could not announce", "announce", self.Announce, "error", err)
+        }
+
+        select {
+        case <-timer.C:
+            interval *= 2
+            if interval > maxAnnounceInterval {
+                interval = maxAnnounceInterval
+            }
+        case <-self.reannounce:
+            if !timer.Stop() {
+                <-timer.C
+            }
+            interval = announceInterval
+        }
+        timer.Reset(interval)
+    }
+}
+
+// what we announce changed. announce it now, and often for a while
+func (self *Server) announceChanged() {
+    select {
+    case self.reannounce <- true:
+    default:
+    }
+}
+
+// does the server have a pool for clients of version
+func (self announcement) serves(version int) bool {
+    if self.Version == version {
+        return true
+    }
+    for _, v := range self.PoolVersions {
+        if v == version {
+            return true
+        }
+    }
+    return false
+}
+
+// servers a client has heard announcing themselves
+type discovery struct {
+    lock sync.Mutex
+    conn net.PacketConn
+    servers map[string]*discovered
+}
+
+type discovered struct {
+    announcement
+    seen time.Time
+}
+
+// start listening for announcements. multicast groups can be shared by any
+// number of clients on a host, plain ports only by one
+func (self *Client) discover() (*discovery, error) {
+    local, err := net.ResolveUDPAddr("udp", self.Discover)
+    if err != nil {
+        return nil, err
+    }
+
+    var conn net.PacketConn
+    if local.IP != nil && local.IP.IsMulticast() {
+        conn, err = net.ListenMulticastUDP("udp", nil, local)
+    } else {
+        conn, err = net.ListenUDP("udp", local)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    d := &discovery{conn: conn, servers: make(map[string]*discovered)}
+    go d.listen(self.Version)
+    return d, nil
+}
+
+func (self *discovery) listen(version int) {
+    buf := make([]byte, 65536)
+    for {
+        n, from, err := self.conn.ReadFrom(buf)
+        if err != nil {
+            // closed
+            return
+        }
+
+        var msg announcement
+        err = gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&msg)
+        if err != nil || !msg.serves(version) {
+            continue
+        }
+        addr := msg.Addr
+        if addr == "" {
+            udp, ok := from.(*net.UDPAddr)
+            if !ok {
+                continue
+            }
+            addr = net.JoinHostPort(udp.IP.String(), strconv.Itoa(msg.Port))
+        }
+
+        self.lock.Lock()
+        self.servers[addr] = &discovered{msg, time.Now()}
+        self.lock.Unlock()
+    }
+}
+
+// compatible servers heard from lately. the one we're attached to comes
+// first, then other active servers, then standbys
+func (self *discovery) addrs(serverId int) []string {
+    type candidate struct {
+        addr string
+        rank int
+    }
+    var candidates []candidate
+
+    self.lock.Lock()
+    for addr, server := range self.servers {
+        next := server.Next
+        if next == 0 {
+            // from a server which announces every announceInterval
+            next = announceInterval
+        }
+        if time.Since(server.seen) > announceMisses * next {
+            delete(self.servers, addr)
+            continue
+        }
+        rank := 1
+        if server.ServerId == serverId && !server.Standby {
+            rank = 0
+        } else if server.Standby {
+            rank = 2
+        }
+        candidates = append(candidates, candidate{addr, rank})
+    }
+    self.lock.Unlock()
+
+    sort.Slice(candidates, func(i, j int) bool {
+        if candidates[i].rank != candidates[j].rank {
+            return candidates[i].rank < candidates[j].rank
+        }
+        return candidates[i].addr < candidates[j].addr
+    })
+
+    var result []string
+    for _, c := range candidates {
+        result = append(result, c.addr)
+    }
+    return result
+}
+
+func (self *discovery) close() {
+    self.conn.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package silk
+
+import (
+    "syscall"
+)
+
+// announcing to a broadcast address is only supported on unix
+func allowBroadcast(network string, address string, conn syscall.RawConn) error {
+    return nil
+}
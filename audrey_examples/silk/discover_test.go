@@ -0,0 +1,106 @@
+package silk
+
+import (
+    "io"
+    "net"
+    "time"
+    "bytes"
+    "testing"
+    "log/slog"
+    "encoding/gob"
+)
+
+// a free loopback UDP address to announce on
+func freeUDPAddr(t *testing.T) string {
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    return conn.LocalAddr().String()
+}
+
+func TestDiscoveryPicksCompatibleServer(t *testing.T) {
+    logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+    group := freeUDPAddr(t)
+
+    serve := func(s *Server) *Server {
+        joined, _ := s.Serve()
+        go func() {
+            for range joined {
+            }
+        }()
+        return s
+    }
+    other := serve(&Server{Version: 2, Listen: freeAddr(t), Announce: group, Logger: logger})
+    compatible := serve(&Server{Version: 1, Listen: freeAddr(t), Announce: group, Logger: logger})
+    standby := serve(&Server{Version: 1, Listen: freeAddr(t), Announce: group, Standby: compatible.Listen, Logger: logger})
+
+    client := &Client{Version: 1, Discover: group, Heartbeat: 100 * time.Millisecond, RetryBackoff: 100 * time.Millisecond, Logger: logger}
+    go client.Run()
+
+    deadline := time.Now().Add(10 * time.Second)
+    for len(compatible.Nodes()) == 0 {
+        if time.Now().After(deadline) {
+            t.Fatal("client never joined the compatible server")
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+    first := compatible.Nodes()[0]
+
+    // while announcements keep coming, slower and slower
+    time.Sleep(3 * time.Second)
+
+    nodes := compatible.Nodes()
+    if len(nodes) != 1 || nodes[0].Id != first.Id || nodes[0].Rejoins != 0 {
+        t.Errorf("client didn't stay on the compatible server: first %+v, now %+v", first, nodes)
+    }
+    if n := len(other.Nodes()); n != 0 {
+        t.Errorf("%d nodes joined the server of another version", n)
+    }
+    if n := len(standby.Nodes()); n != 0 {
+        t.Errorf("%d nodes joined the standby", n)
+    }
+}
+
+func TestAnnounceBacksOff(t *testing.T) {
+    logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    s := &Server{Version: 1, Listen: freeAddr(t), Announce: conn.LocalAddr().String(), Logger: logger}
+    s.Serve()
+
+    buf := make([]byte, 65536)
+    next := func() announcement {
+        var msg announcement
+        conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+        n, _, err := conn.ReadFrom(buf)
+        if err == nil {
+            err = gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&msg)
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        return msg
+    }
+
+    for _, want := range []time.Duration{time.Second, 2 * time.Second} {
+        if msg := next(); msg.Next != want || msg.Standby {
+            t.Fatalf("got announcement %+v, want an active server announcing again in %s", msg, want)
+        }
+    }
+
+    // standing down changes the announcement, which goes out right away
+    // and starts over from announcing every second
+    _, term := s.currentTerm()
+    start := time.Now()
+    s.standDown(term + 1)
+    msg := next()
+    if !msg.Standby || msg.Next != time.Second || time.Since(start) > time.Second {
+        t.Errorf("got announcement %+v after %s, want a standby announcing again in 1s right away", msg, time.Since(start))
+    }
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package silk
+
+import (
+    "syscall"
+)
+
+// announcements may go to a broadcast address, which needs SO_BROADCAST
+func allowBroadcast(network string, address string, conn syscall.RawConn) error {
+    var err error
+    ctlErr := conn.Control(func(fd uintptr) {
+        err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+    })
+    if ctlErr != nil {
+        return ctlErr
+    }
+    return err
+}
@@ -0,0 +1,113 @@
+package silk
+
+import (
+    "sync"
+    "time"
+)
+
+// something that happened in the cluster
+type Event struct {
+    Time time.Time
+    Kind string
+    NodeId int // -1 if not about a node
+    TaskId int // -1 if not about a task
+    Message string
+}
+
+const (
+    EventNodeJoined = "node-joined"
+    EventNodeRejoined = "node-rejoined"
+    EventNodeTimeout = "node-timeout"
+    EventNodeDraining = "node-draining"
+    EventNodeQuarantined = "node-quarantined"
+    EventNodeReleased = "node-released"
+    EventTaskSubmitted = "task-submitted"
+    EventTaskDispatched = "task-dispatched"
+    EventTaskRescheduled = "task-rescheduled"
+    EventTaskDone = "task-done"
+    EventTaskFailed = "task-failed"
+    EventTaskCancelled = "task-cancelled"
+    EventTakeover = "takeover"
+)
+
+// how many events are kept for late subscribers
+const eventHistory = 1000
+
+// ring buffer of recent events plus live subscribers
+// subscribers which fall behind miss events rather than stalling the server
+type eventLog struct {
+    lock sync.Mutex
+    recent []Event
+    subscribers map[chan Event]bool
+}
+
+func newEventLog() *eventLog {
+    return &eventLog{subscribers: make(map[chan Event]bool)}
+}
+
+func (self *eventLog) emit(kind string, nodeId int, taskId int, message string) {
+    event := Event{time.Now(), kind, nodeId, taskId, message}
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.recent = append(self.recent, event)
+    if len(self.recent) > eventHistory {
+        self.recent = self.recent[len(self.recent) - eventHistory:]
+    }
+    for subscriber := range self.subscribers {
+        select {
+        case subscriber <- event:
+        default:
+        }
+    }
+}
+
+// returns the recent history and a channel of everything after it
+func (self *eventLog) subscribe() ([]Event, chan Event) {
+    subscriber := make(chan Event, 100)
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.subscribers[subscriber] = true
+    return append([]Event{}, self.recent...), subscriber
+}
+
+func (self *eventLog) unsubscribe(subscriber chan Event) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    delete(self.subscribers, subscriber)
+}
+
+// the last n events of the given kinds, oldest first
+func (self *eventLog) last(n int, kinds ...string) []Event {
+    var result []Event
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    for i := len(self.recent) - 1; i >= 0 && len(result) < n; i-- {
+        for _, kind := range kinds {
+            if self.recent[i].Kind == kind {
+                result = append(result, self.recent[i])
+                break
+            }
+        }
+    }
+
+    for i, j := 0, len(result) - 1; i < j; i, j = i + 1, j - 1 {
+        result[i], result[j] = result[j], result[i]
+    }
+    return result
+}
+
+// recent events and a live feed of new ones. call the returned function
+// once you stop reading
+func (self *Server) Events() ([]Event, chan Event, func()) {
+    recent, live := self.events.subscribe()
+    return recent, live, func() {
+        self.events.unsubscribe(live)
+    }
+}
@@ -0,0 +1,196 @@
+package silk
+
+import (
+    "fmt"
+    "sync"
+)
+
+// a set of tasks submitted and tracked together
+type TaskGroup struct {
+    lock sync.Mutex
+    changed *sync.Cond
+
+    stop chan bool
+    stopped bool
+
+    latest []Task // latest checkpoint of each task, in submission order
+    ended []bool
+    order []int // indices of ended tasks, in the order they ended
+    checkpoints int
+    failed int
+}
+
+// snapshot of a group's state
+type GroupProgress struct {
+    Total int
+    Running int
+    Finished int // done, including failures
+    Failed int
+    Cancelled int
+    Checkpoints int // received across all tasks
+}
+
+// submit many tasks as one group. none of the calls block
+func (self *Server) SubmitGroup(tasks []Task) *TaskGroup {
+    group := &TaskGroup{
+        stop: make(chan bool),
+        latest: make([]Task, len(tasks)),
+        ended: make([]bool, len(tasks)),
+    }
+    group.changed = sync.NewCond(&group.lock)
+
+    for i, t := range tasks {
+        group.latest[i] = t
+        sub, err := self.SubmitTaskWith(t, TaskOptions{})
+        if err != nil {
+            sub = self.failedSubmission(t, err)
+        }
+        go group.follow(i, sub)
+    }
+    return group
+}
+
+// one goroutine per member task collects its checkpoints
+func (self *TaskGroup) follow(i int, sub *Submission) {
+    stop := self.stop
+
+    for {
+        select {
+        case checkpoint, ok := <-sub.Checkpoints:
+            self.lock.Lock()
+            if !ok {
+                self.ended[i] = true
+                self.order = append(self.order, i)
+                self.changed.Broadcast()
+                self.lock.Unlock()
+                return
+            }
+            self.latest[i] = checkpoint
+            self.checkpoints++
+            if _, failed := checkpoint.(TaskFailed); failed {
+                self.failed++
+            }
+            self.lock.Unlock()
+        case <-stop:
+            stop = nil
+            sub.Cancel()
+        }
+    }
+}
+
+// cancel every task in the group which hasn't ended yet
+func (self *TaskGroup) Cancel() {
+    self.lock.Lock()
+    if !self.stopped {
+        self.stopped = true
+        close(self.stop)
+    }
+    self.lock.Unlock()
+}
+
+// wait for every task to end. returns the final checkpoint of each task in
+// submission order. failed tasks end in TaskFailed, cancelled tasks end in
+// whatever checkpoint they last reached
+func (self *TaskGroup) Wait() []Task {
+    return self.WaitN(len(self.latest))
+}
+
+// wait for the first n tasks to end and return their final checkpoints in the
+// order they ended
+func (self *TaskGroup) WaitN(n int) []Task {
+    if n > len(self.latest) {
+        n = len(self.latest)
+    }
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for len(self.order) < n {
+        self.changed.Wait()
+    }
+
+    if n == len(self.latest) {
+        // everyone's done, keep submission order
+        return append([]Task{}, self.latest...)
+    }
+    result := make([]Task, n)
+    for j, i := range self.order[:n] {
+        result[j] = self.latest[i]
+    }
+    return result
+}
+
+func (self *TaskGroup) Progress() GroupProgress {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    progress := GroupProgress{
+        Total: len(self.latest),
+        Running: len(self.latest) - len(self.order),
+        Failed: self.failed,
+        Checkpoints: self.checkpoints,
+    }
+    for _, i := range self.order {
+        if self.latest[i].IsDone() {
+            progress.Finished++
+        } else {
+            progress.Cancelled++
+        }
+    }
+    return progress
+}
+
+// run tasks as a group, then submit the task built by reduce from their
+// final checkpoints. the returned channels behave like SubmitTask's and
+// follow the reduce task: the stream only holds the latest checkpoint, so
+// nobody has to read it before cancelling. if any map task fails the stream
+// ends in TaskFailed
+func (self *Server) MapReduce(tasks []Task, reduce func([]Task) Task) (chan Task, chan bool) {
+    out := make(chan Task, 1)
+    cancel := make(chan bool, 1)
+    group := self.SubmitGroup(tasks)
+
+    go func() {
+        defer close(out)
+
+        mapped := make(chan []Task)
+        go func() {
+            mapped <- group.Wait()
+        }()
+
+        var results []Task
+        select {
+        case results = <-mapped:
+        case <-cancel:
+            group.Cancel()
+            <-mapped
+            return
+        }
+
+        for i, result := range results {
+            if failure, ok := result.(TaskFailed); ok {
+                offer[Task](out, TaskFailed{fmt.Sprintf("map task %d failed: %s", i, failure.Reason), nil})
+                return
+            }
+        }
+
+        t := reduce(results)
+        sub, err := self.SubmitTaskWith(t, TaskOptions{})
+        if err != nil {
+            sub = self.failedSubmission(t, err)
+        }
+        for {
+            select {
+            case checkpoint, ok := <-sub.Checkpoints:
+                if !ok {
+                    return
+                }
+                offer(out, checkpoint)
+            case <-cancel:
+                cancel = nil
+                sub.Cancel()
+            }
+        }
+    }()
+
+    return out, cancel
+}
@@ -0,0 +1,513 @@
+package silk
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "errors"
+    "net/http"
+    "encoding/gob"
+)
+
+var ErrStandby = errors.New("server is standing by, submit to the active server")
+
+// how often an active server pings its standbys when nothing else happens
+const replicationPing = time.Second
+
+// how many journal entries a standby can fall behind by before it's cut off
+// and has to start over from a fresh snapshot
+const journalBacklog = 1000
+
+type journalKind int
+
+const (
+    journalHello journalKind = iota // start of a snapshot, ServerId, Version and Term
+    journalPing
+    journalTask // TaskId was submitted or checkpointed, Task is the latest
+    journalDispatch // TaskId went to NodeId
+    journalRequeue // TaskId went back in the queue
+    journalEnd // TaskId ended
+    journalNode // NodeId joined
+    journalNodeGone // NodeId timed out
+    journalKey // Key belongs to TaskId. if it ended, Task is how and Expires is set
+    journalSchedules // Schedules is every recurring task
+)
+
+// TaskFailed goes to standbys as the end of tasks with idempotency keys
+func init() {
+    gob.Register(TaskFailed{})
+}
+
+// one change to the server's state, as streamed to standbys over GET
+// /replicate. applying an entry twice is harmless, so entries which race
+// with the snapshot a standby starts from don't matter
+type journalEntry struct {
+    Kind journalKind
+    ServerId int
+    Version int
+    TaskId int
+    Task Task
+    Tenant string
+    Pool string
+    Priority int
+    Placement Placement
+    NodeId int
+    Caps ClientCaps
+    Addr string
+    Term int
+    Key string
+    Expires time.Time
+    Schedules []persistedSchedule
+}
+
+// fans journal entries out to connected standbys
+type journal struct {
+    lock sync.Mutex
+    subscribers map[chan journalEntry]bool
+}
+
+func newJournal() *journal {
+    return &journal{subscribers: make(map[chan journalEntry]bool)}
+}
+
+func (self *journal) emit(entry journalEntry) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    for ch := range self.subscribers {
+        select {
+        case ch <- entry:
+        default:
+            // fell behind. it gets a fresh snapshot when it reconnects
+            delete(self.subscribers, ch)
+            close(ch)
+        }
+    }
+}
+
+func (self *journal) subscribe() chan journalEntry {
+    ch := make(chan journalEntry, journalBacklog)
+
+    self.lock.Lock()
+    self.subscribers[ch] = true
+    self.lock.Unlock()
+
+    return ch
+}
+
+func (self *journal) unsubscribe(ch chan journalEntry) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if self.subscribers[ch] {
+        delete(self.subscribers, ch)
+        close(ch)
+    }
+}
+
+// ServerId changes on takeover, or a simulated restart under Chaos
+func (self *Server) currentServerId() int {
+    self.haLock.Lock()
+    defer self.haLock.Unlock()
+
+    return self.ServerId
+}
+
+// ServerId, and the term we're serving it in
+func (self *Server) currentTerm() (int, int) {
+    self.haLock.Lock()
+    defer self.haLock.Unlock()
+
+    return self.ServerId, self.term
+}
+
+func (self *Server) isActive() bool {
+    self.haLock.Lock()
+    defer self.haLock.Unlock()
+
+    return self.active
+}
+
+// a standby took over from us while we were out of touch, and it's serving
+// term now. stop handing out tasks, which it may be handing out too
+func (self *Server) standDown(term int) {
+    self.haLock.Lock()
+    if !self.active || term <= self.term {
+        self.haLock.Unlock()
+        return
+    }
+    self.active = false
+    self.term = term
+    self.haLock.Unlock()
+    self.announceChanged()
+
+    self.log().Error("another server took over from us, standing by", "term", term, "standby_of", self.Standby)
+    self.events.emit(EventTakeover, -1, -1, fmt.Sprintf("stood down for term %d", term))
+    self.stopSchedules()
+    if self.Standby != "" {
+        go self.replicate()
+    }
+}
+
+// everything a standby needs to start from
+func (self *Server) journalSnapshot() []journalEntry {
+    serverId, term := self.currentTerm()
+    entries := []journalEntry{{Kind: journalHello, ServerId: serverId, Version: self.Version, Term: term}}
+
+    self.nodeLock.Lock()
+    for id, node := range self.nodes {
+        entries = append(entries, journalEntry{Kind: journalNode, NodeId: id, Caps: node.Caps, Addr: node.Addr})
+    }
+    self.nodeLock.Unlock()
+
+    self.taskLock.Lock()
+    for id, rec := range self.tasks {
+        if rec.status.State != TaskQueued && rec.status.State != TaskRunning {
+            continue
+        }
+        latest := rec.latest
+        if latest == nil {
+            latest = rec.submitted
+        }
+        entries = append(entries, journalEntry{Kind: journalTask, TaskId: id, Task: latest, Tenant: rec.status.Tenant, Pool: rec.pool.name, Priority: rec.priority, Placement: rec.placement})
+        if rec.status.State == TaskRunning {
+            entries = append(entries, journalEntry{Kind: journalDispatch, TaskId: id, NodeId: rec.status.NodeId})
+        }
+    }
+    self.taskLock.Unlock()
+
+    self.keyLock.Lock()
+    for key, keyed := range self.keys {
+        if keyed.id != 0 {
+            entries = append(entries, journalEntry{Kind: journalKey, Key: key, TaskId: keyed.id, Task: keyed.final, Expires: keyed.expires})
+        }
+    }
+    self.keyLock.Unlock()
+
+    entries = append(entries, journalEntry{Kind: journalSchedules, Schedules: self.persistedSchedules()})
+    return entries
+}
+
+// GET /replicate streams a snapshot and then live journal entries to a standby
+func (self *Server) serveJournal(w http.ResponseWriter, r *http.Request) {
+    if !self.isActive() {
+        http.Error(w, "Standby", 503)
+        return
+    }
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        http.Error(w, "Streaming unsupported", 500)
+        return
+    }
+
+    // subscribe first so nothing falls between the snapshot and the stream
+    live := self.journal.subscribe()
+    defer self.journal.unsubscribe(live)
+
+    log := self.log().With(logRemoteAddr, r.RemoteAddr)
+    log.Info("standby connected")
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    e := gob.NewEncoder(w)
+    for _, entry := range self.journalSnapshot() {
+        if e.Encode(&entry) != nil {
+            return
+        }
+    }
+    flusher.Flush()
+
+    ticker := time.NewTicker(replicationPing)
+    defer ticker.Stop()
+
+    for {
+        var entry journalEntry
+        select {
+        case entry, ok = <-live:
+            if !ok {
+                log.Warn("standby fell behind, dropping it")
+                return
+            }
+        case <-ticker.C:
+            entry = journalEntry{Kind: journalPing}
+        case <-r.Context().Done():
+            log.Info("standby disconnected")
+            return
+        }
+        if e.Encode(&entry) != nil {
+            return
+        }
+        flusher.Flush()
+    }
+}
+
+// a standby's copy of the active server's state
+type replica struct {
+    serverId int // 0 until a snapshot has been received
+    term int
+    tasks map[int]*replicaTask
+    nodes map[int]*replicaNode
+    keys map[string]journalEntry // the latest journalKey for each key
+    schedules []persistedSchedule
+    scheduled bool // schedules came with the snapshot
+    lastTaskId int // ended tasks included, so their ids aren't used again
+}
+
+type replicaTask struct {
+    task Task
+    tenant string
+    pool string
+    priority int
+    placement Placement
+    nodeId int // -1 while queued
+}
+
+type replicaNode struct {
+    caps ClientCaps
+    addr string
+}
+
+func (self *replica) apply(entry journalEntry) {
+    switch entry.Kind {
+    case journalHello:
+        self.serverId = entry.ServerId
+        self.term = entry.Term
+        self.tasks = make(map[int]*replicaTask)
+        self.nodes = make(map[int]*replicaNode)
+        self.keys = make(map[string]journalEntry)
+        self.schedules, self.scheduled = nil, false
+    case journalTask:
+        t, ok := self.tasks[entry.TaskId]
+        if !ok {
+            t = &replicaTask{nodeId: -1}
+            self.tasks[entry.TaskId] = t
+        }
+        t.task = entry.Task
+        t.tenant = entry.Tenant
+        t.pool = entry.Pool
+        t.priority = entry.Priority
+        t.placement = entry.Placement
+    case journalDispatch:
+        if t, ok := self.tasks[entry.TaskId]; ok {
+            t.nodeId = entry.NodeId
+        }
+    case journalRequeue:
+        if t, ok := self.tasks[entry.TaskId]; ok {
+            t.nodeId = -1
+        }
+    case journalEnd:
+        delete(self.tasks, entry.TaskId)
+    case journalNode:
+        self.nodes[entry.NodeId] = &replicaNode{entry.Caps, entry.Addr}
+    case journalNodeGone:
+        delete(self.nodes, entry.NodeId)
+    case journalKey:
+        self.keys[entry.Key] = entry
+    case journalSchedules:
+        self.schedules, self.scheduled = entry.Schedules, true
+    }
+    if entry.TaskId > self.lastTaskId {
+        self.lastTaskId = entry.TaskId
+    }
+}
+
+// runs for as long as the server is standing by
+func (self *Server) replicate() {
+    var state replica
+    lastHeard := time.Now()
+
+    for {
+        heard := lastHeard
+        err := self.followActive(&state, &lastHeard)
+        if lastHeard != heard {
+            self.log().Warn("lost replication stream", "active", self.Standby, "error", err)
+        } else {
+            self.log().Debug("could not replicate", "active", self.Standby, "error", err)
+        }
+
+        if state.serverId != 0 && time.Since(lastHeard) > self.FailoverTimeout {
+            self.takeover(&state)
+            return
+        }
+        time.Sleep(self.FailoverTimeout / 10)
+    }
+}
+
+// apply the active server's journal until the stream breaks or goes quiet
+func (self *Server) followActive(state *replica, lastHeard *time.Time) error {
+    resp, err := http.Get(fmt.Sprintf("http://%s/replicate", self.Standby))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 400 {
+        return fmt.Errorf("replication failed with HTTP %d", resp.StatusCode)
+    }
+
+    entries := make(chan journalEntry)
+    failed := make(chan error, 1)
+    done := make(chan bool)
+    defer close(done)
+    go func() {
+        d := gob.NewDecoder(resp.Body)
+        for {
+            var entry journalEntry
+            err := d.Decode(&entry)
+            if err != nil {
+                failed <- err
+                return
+            }
+            select {
+            case entries <- entry:
+            case <-done:
+                return
+            }
+        }
+    }()
+
+    for {
+        select {
+        case entry := <-entries:
+            if entry.Kind == journalHello && entry.Version != self.Version {
+                return fmt.Errorf("active server is version %d, we are %d", entry.Version, self.Version)
+            }
+            state.apply(entry)
+            *lastHeard = time.Now()
+        case err := <-failed:
+            return err
+        case <-time.After(self.FailoverTimeout):
+            // closing the body unblocks the decoder
+            return errors.New("active server went quiet")
+        }
+    }
+}
+
+// become the active server, carrying on where the old one left off. nodes
+// come back under their old ids since we use the old ServerId, and tasks
+// keep their ids. checkpoints of restored tasks can be followed with Attach
+// we serve the next term, so nodes which find us stop listening to the old
+// server, and it stands down when they tell it
+func (self *Server) takeover(state *replica) {
+    self.log().Warn("taking over from active server", "active", self.Standby, "old_server_id", self.currentServerId(), "term", state.term + 1, "tasks", len(state.tasks), "nodes", len(state.nodes))
+
+    // under haLock since announce reads it
+    self.haLock.Lock()
+    self.ServerId = state.serverId
+    self.term = state.term + 1
+    self.haLock.Unlock()
+    self.relog()
+
+    self.taskLock.Lock()
+    if state.lastTaskId >= self.nextTaskId {
+        self.nextTaskId = state.lastTaskId + 1
+    }
+    self.taskLock.Unlock()
+
+    self.nodeLock.Lock()
+    for id := range state.nodes {
+        if id >= self.nextNodeId {
+            self.nextNodeId = id + 1
+        }
+    }
+    self.nodeLock.Unlock()
+
+    running := make(map[int]int)
+    for id, t := range state.tasks {
+        if _, ok := state.nodes[t.nodeId]; ok {
+            running[t.nodeId] = id
+        } else {
+            t.nodeId = -1
+        }
+    }
+
+    // tasks first, so a node timing out finds its task to requeue
+    for id, t := range state.tasks {
+        var labels map[string]string
+        if t.nodeId != -1 {
+            node := state.nodes[t.nodeId]
+            labels = nodeLabels(node.caps, node.addr)
+        }
+        self.restoreTask(id, t, labels)
+    }
+    var joined []ClientCaps
+    for id, node := range state.nodes {
+        curTask, ok := running[id]
+        if !ok {
+            curTask = -1
+        }
+        self.addNode(id, node.caps, node.addr, curTask)
+        joined = append(joined, node.caps)
+    }
+    // whoever reads the node channel may not have been reading while we
+    // stood by, and taking over doesn't wait for them
+    go func() {
+        for _, caps := range joined {
+            self.nodeEvents <- caps
+        }
+    }()
+    self.restoreKeys(state.keys)
+
+    self.haLock.Lock()
+    self.active = true
+    self.haLock.Unlock()
+    self.announceChanged()
+
+    self.events.emit(EventTakeover, -1, -1, fmt.Sprintf("took over from %s", self.Standby))
+    if state.scheduled {
+        self.startSchedules(state.schedules)
+        self.saveSchedules()
+    } else {
+        self.loadSchedules()
+    }
+}
+
+// pick up a task replicated from the old active server
+func (self *Server) restoreTask(id int, t *replicaTask, labels map[string]string) {
+    pool, err := self.pool(t.pool)
+    if err != nil {
+        // configured differently from the old active server
+        self.log().Warn("restored task to the default pool", logTaskId, id, "error", err)
+        pool = self.pools[DefaultPool]
+    }
+
+    rec := &taskRecord{
+        id: id,
+        submitted: t.task,
+        priority: t.priority,
+        placement: t.placement,
+        pool: pool,
+    }
+    rec.status = TaskStatus{
+        Id: id,
+        Type: fmt.Sprintf("%T", t.task),
+        Tenant: t.tenant,
+        Pool: pool.name,
+        State: TaskQueued,
+        NodeId: -1,
+        Submitted: time.Now(),
+    }
+    rec.span = startSpan(TraceContext{}, "task", "task_id", fmt.Sprint(id), "type", rec.status.Type, "tenant", t.tenant, "restored", "true")
+
+    running := t.nodeId != -1
+    if running {
+        rec.status.State = TaskRunning
+        rec.status.NodeId = t.nodeId
+        rec.attemptSpan = startSpan(rec.span.context(), "attempt", "node_id", fmt.Sprint(t.nodeId))
+        rec.lastReport = rec.attemptSpan.Start
+    } else {
+        rec.queuedSpan = startSpan(rec.span.context(), "queued")
+    }
+
+    // the submitter went down with the old server, so nobody follows it
+    // until someone attaches
+    rec.lock.Lock()
+    self.taskLock.Lock()
+    self.tasks[id] = rec
+    self.taskLock.Unlock()
+
+    rec.item = pool.queue.restore(taskWithId{id, t.task}, t.tenant, t.priority, t.placement, labels)
+    rec.lock.Unlock()
+    self.journal.emit(journalEntry{Kind: journalTask, TaskId: id, Task: t.task, Tenant: t.tenant, Pool: pool.name, Priority: t.priority, Placement: t.placement})
+    if running {
+        self.journal.emit(journalEntry{Kind: journalDispatch, TaskId: id, NodeId: t.nodeId})
+    }
+}
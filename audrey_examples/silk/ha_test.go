@@ -0,0 +1,199 @@
+package silk
+
+import (
+    "io"
+    "net"
+    "sync"
+    "time"
+    "bytes"
+    "testing"
+    "net/http"
+    "log/slog"
+    "encoding/gob"
+)
+
+type haTestTask struct {
+    N int
+}
+
+func (self haTestTask) IsDone() bool {
+    return false
+}
+
+func (self haTestTask) Run(progress chan Task, cancel chan bool) {
+    <-cancel
+}
+
+func init() {
+    RegisterTaskType(haTestTask{})
+}
+
+// a free loopback address to listen on
+func freeAddr(t *testing.T) string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    return l.Addr().String()
+}
+
+// forwards connections to target until it's cut, which is as good as the
+// target dying as far as whoever connects through it can tell
+type cuttableProxy struct {
+    listener net.Listener
+    lock sync.Mutex
+    conns []net.Conn
+}
+
+func newCuttableProxy(t *testing.T, target string) *cuttableProxy {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    p := &cuttableProxy{listener: l}
+    go func() {
+        for {
+            c, err := l.Accept()
+            if err != nil {
+                return
+            }
+            u, err := net.Dial("tcp", target)
+            if err != nil {
+                c.Close()
+                continue
+            }
+            p.lock.Lock()
+            p.conns = append(p.conns, c, u)
+            p.lock.Unlock()
+            go io.Copy(c, u)
+            go io.Copy(u, c)
+        }
+    }()
+    return p
+}
+
+func (self *cuttableProxy) cut() {
+    self.listener.Close()
+    self.lock.Lock()
+    for _, c := range self.conns {
+        c.Close()
+    }
+    self.lock.Unlock()
+}
+
+// post one sync to the server at addr
+func postSync(t *testing.T, addr string, req SyncRequest) (SyncResponse, int) {
+    var resp SyncResponse
+    buf := bytes.Buffer{}
+    err := gob.NewEncoder(&buf).Encode(&req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r, err := http.Post("http://" + addr + "/sync", "application/octet-stream", &buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Body.Close()
+    if r.StatusCode == 200 {
+        err = gob.NewDecoder(r.Body).Decode(&resp)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    return resp, r.StatusCode
+}
+
+func TestFailover(t *testing.T) {
+    logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+    active := &Server{Version: 1, Listen: freeAddr(t), Logger: logger}
+    joined, _ := active.Serve()
+    go func() {
+        for range joined {
+        }
+    }()
+    time.Sleep(100 * time.Millisecond)
+
+    // the standby replicates through the proxy, so cutting it kills the
+    // active server as far as the standby can tell
+    proxy := newCuttableProxy(t, active.Listen)
+    standby := &Server{Version: 1, Listen: freeAddr(t), Standby: proxy.listener.Addr().String(), FailoverTimeout: time.Second, Logger: logger}
+    // nobody reads the standby's node channel, which mustn't hold up taking over
+    standby.Serve()
+
+    node, status := postSync(t, active.Listen, SyncRequest{Version: 1, Caps: ClientCaps{NodeId: -1}})
+    if status != 200 {
+        t.Fatalf("node join got %d", status)
+    }
+    live, err := active.SubmitTaskWith(haTestTask{}, TaskOptions{IdempotencyKey: "live"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ended, err := active.SubmitTaskWith(haTestTask{}, TaskOptions{IdempotencyKey: "ended"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    ended.Cancel()
+    _, _, err = active.SubmitRecurring(Schedule{Name: "hourly", Every: time.Hour}, haTestTask{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    serverId, term := active.currentTerm()
+    time.Sleep(500 * time.Millisecond)
+
+    proxy.cut()
+    deadline := time.Now().Add(10 * time.Second)
+    for !standby.isActive() {
+        if time.Now().After(deadline) {
+            t.Fatal("standby never took over")
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+
+    // takeover: the standby serves the same ServerId in the next term, and
+    // knows the node
+    gotId, gotTerm := standby.currentTerm()
+    if gotId != serverId || gotTerm != term + 1 {
+        t.Errorf("standby serves %d in term %d, want %d in term %d", gotId, gotTerm, serverId, term + 1)
+    }
+    known := false
+    for _, n := range standby.Nodes() {
+        known = known || n.Id == node.NodeId
+    }
+    if !known {
+        t.Errorf("standby doesn't know node %d", node.NodeId)
+    }
+
+    // idempotency keys: resubmitting attaches to the same tasks
+    sub, err := standby.SubmitTaskWith(haTestTask{}, TaskOptions{IdempotencyKey: "live"})
+    if err != nil || sub.Id != live.Id {
+        t.Errorf("live key got task %v (%v), want %d", sub, err, live.Id)
+    }
+    sub, err = standby.SubmitTaskWith(haTestTask{}, TaskOptions{IdempotencyKey: "ended"})
+    if err != nil || sub.Id != ended.Id {
+        t.Errorf("ended key got task %v (%v), want %d", sub, err, ended.Id)
+    }
+    sub, err = standby.SubmitTaskWith(haTestTask{}, TaskOptions{})
+    if err != nil || sub.Id <= ended.Id {
+        t.Errorf("fresh task got %v (%v), want an id after %d", sub, err, ended.Id)
+    }
+
+    // schedules
+    if _, ok := standby.NextRuns()["hourly"]; !ok {
+        t.Errorf("schedule wasn't replicated, standby has %v", standby.NextRuns())
+    }
+
+    // term fencing: the old active server is still up, and stands down as
+    // soon as a node tells it about the new term
+    _, status = postSync(t, active.Listen, SyncRequest{Version: 1, ServerId: serverId, Caps: ClientCaps{NodeId: node.NodeId}, Term: term + 1})
+    if status != 503 {
+        t.Errorf("old active server replied %d to a node in the new term, want 503", status)
+    }
+    if _, err = active.SubmitTaskWith(haTestTask{}, TaskOptions{}); err != ErrStandby {
+        t.Errorf("old active server took a task: %v", err)
+    }
+    if len(active.NextRuns()) != 0 {
+        t.Errorf("old active server still runs schedules %v", active.NextRuns())
+    }
+}
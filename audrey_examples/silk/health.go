@@ -0,0 +1,221 @@
+package silk
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "time"
+)
+
+// how much each kind of trouble counts against a node
+const (
+    strikeTimeout = 1.0
+    strikeTaskFailure = 1.0
+    strikeSlowCheckpoint = 0.25
+)
+
+// a node's score halves every healthHalfLife, so old trouble is forgiven
+const healthHalfLife = 10 * time.Minute
+
+// what the server remembers about a machine's reliability. nodes without an
+// Identity come back under new ids, so for those the machine is their host
+type NodeHealth struct {
+    Machine string // the node's Identity, or its silk.host label
+    Timeouts int
+    TaskFailures int
+    SlowCheckpoints int
+    Score float64 // decaying weighted count of the above, 0 is healthy
+    Updated time.Time // when Score was last decayed
+    QuarantinedUntil time.Time // zero if not quarantined
+    Manual bool // quarantined by an operator, until released
+}
+
+// must hold healthLock
+func (self *NodeHealth) decay(now time.Time) {
+    if !self.Updated.IsZero() {
+        self.Score *= math.Pow(0.5, float64(now.Sub(self.Updated)) / float64(healthHalfLife))
+    }
+    self.Updated = now
+}
+
+// must hold healthLock. lapsed quarantines start over with a clean score
+func (self *NodeHealth) quarantined(now time.Time) bool {
+    if self.Manual {
+        return true
+    }
+    if self.QuarantinedUntil.IsZero() {
+        return false
+    }
+    if now.Before(self.QuarantinedUntil) {
+        return true
+    }
+    self.QuarantinedUntil = time.Time{}
+    self.Score = 0
+    return false
+}
+
+// which machine health is kept under for a node with these caps
+func machine(caps ClientCaps) string {
+    if caps.Identity != "" {
+        return caps.Identity
+    }
+    return caps.Labels[HostLabel]
+}
+
+// must hold healthLock
+func (self *Server) healthOf(machine string) *NodeHealth {
+    health, ok := self.health[machine]
+    if !ok {
+        health = &NodeHealth{Machine: machine}
+        self.health[machine] = health
+    }
+    return health
+}
+
+// count trouble against the machine a node runs on, quarantining it once its
+// score reaches QuarantineScore. tally bumps the matching counter
+func (self *Server) strike(nodeId int, machine string, weight float64, reason string, tally func(*NodeHealth)) {
+    now := time.Now()
+
+    self.healthLock.Lock()
+    health := self.healthOf(machine)
+    tally(health)
+    health.decay(now)
+    health.Score += weight
+    wasQuarantined := health.quarantined(now)
+    quarantine := !wasQuarantined && health.Score >= self.QuarantineScore
+    if quarantine {
+        health.QuarantinedUntil = now.Add(self.QuarantineCooldown)
+    }
+    score := health.Score
+    self.healthLock.Unlock()
+
+    self.log().Debug("node strike", logNodeId, nodeId, "machine", machine, "reason", reason, "score", score)
+    if quarantine {
+        self.log().Warn("quarantining machine", logNodeId, nodeId, "machine", machine, "score", score, "until", now.Add(self.QuarantineCooldown))
+        self.events.emit(EventNodeQuarantined, nodeId, -1, fmt.Sprintf("%s: %s, score %.2f", machine, reason, score))
+    }
+}
+
+// only nodes which were running a task count. an idle node going away is
+// most likely a client which exited or restarted, and cost nothing
+func (self *Server) nodeTimedOut(nodeId int, machine string, taskId int) {
+    if taskId == -1 {
+        return
+    }
+    self.strike(nodeId, machine, strikeTimeout, "timed out", func(health *NodeHealth) {
+        health.Timeouts++
+    })
+}
+
+// only counts if some other machine has run rec without it failing. a task
+// which fails wherever it runs is the task's fault, not the node's
+func (self *Server) nodeTaskFailed(nodeId int, machine string, rec *taskRecord) {
+    self.taskLock.Lock()
+    elsewhere := false
+    for other := range rec.ranOn {
+        elsewhere = elsewhere || other != machine
+    }
+    self.taskLock.Unlock()
+
+    if elsewhere {
+        self.strike(nodeId, machine, strikeTaskFailure, "task failed", func(health *NodeHealth) {
+            health.TaskFailures++
+        })
+    }
+}
+
+// machine checkpointed rec, so the task can run there
+func (self *Server) taskRanOn(rec *taskRecord, machine string) {
+    self.taskLock.Lock()
+    if rec.ranOn == nil {
+        rec.ranOn = make(map[string]bool)
+    }
+    rec.ranOn[machine] = true
+    self.taskLock.Unlock()
+}
+
+// checkpoints further apart than SlowCheckpoint count against the node
+func (self *Server) nodeCheckpointed(nodeId int, machine string, interval time.Duration) {
+    if self.SlowCheckpoint > 0 && interval > self.SlowCheckpoint {
+        self.strike(nodeId, machine, strikeSlowCheckpoint, fmt.Sprintf("checkpoint took %s", interval), func(health *NodeHealth) {
+            health.SlowCheckpoints++
+        })
+    }
+}
+
+func (self *Server) machineQuarantined(machine string) bool {
+    self.healthLock.Lock()
+    defer self.healthLock.Unlock()
+
+    health, ok := self.health[machine]
+    return ok && health.quarantined(time.Now())
+}
+
+// the machine a node runs on
+func (self *Server) nodeMachine(id int) (string, bool) {
+    self.nodeLock.Lock()
+    defer self.nodeLock.Unlock()
+
+    node, ok := self.nodes[id]
+    if !ok {
+        return "", false
+    }
+    return machine(node.Caps), true
+}
+
+// stop handing new tasks to the machine a node runs on until ReleaseNode.
+// what its nodes are running is left alone
+func (self *Server) QuarantineNode(id int) error {
+    machine, ok := self.nodeMachine(id)
+    if !ok {
+        return fmt.Errorf("no such node %d", id)
+    }
+
+    self.healthLock.Lock()
+    self.healthOf(machine).Manual = true
+    self.healthLock.Unlock()
+
+    self.log().Warn("quarantining machine by hand", logNodeId, id, "machine", machine)
+    self.events.emit(EventNodeQuarantined, id, -1, fmt.Sprintf("%s: by hand", machine))
+    return nil
+}
+
+// lift a quarantine, manual or automatic, on the machine a node runs on, and
+// forgive its score
+func (self *Server) ReleaseNode(id int) error {
+    machine, ok := self.nodeMachine(id)
+    if !ok {
+        return fmt.Errorf("no such node %d", id)
+    }
+
+    self.healthLock.Lock()
+    health := self.healthOf(machine)
+    health.Manual = false
+    health.QuarantinedUntil = time.Time{}
+    health.Score = 0
+    self.healthLock.Unlock()
+
+    self.log().Info("released machine", logNodeId, id, "machine", machine)
+    self.events.emit(EventNodeReleased, id, -1, machine)
+    return nil
+}
+
+// every machine the server has seen trouble from
+func (self *Server) Health() []NodeHealth {
+    var result []NodeHealth
+    now := time.Now()
+
+    self.healthLock.Lock()
+    for _, health := range self.health {
+        health.decay(now)
+        health.quarantined(now)
+        result = append(result, *health)
+    }
+    self.healthLock.Unlock()
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].Machine < result[j].Machine
+    })
+    return result
+}
@@ -0,0 +1,144 @@
+package silk
+
+import (
+    "sort"
+    "time"
+)
+
+// a task submitted with an idempotency key
+type keyedTask struct {
+    key string
+    id int // of record, 0 until it's in line
+    record *taskRecord
+    expires time.Time // zero while the task is still going
+    final Task // how the task ended, once it has
+}
+
+// register rec under key, unless a live task already holds the key, in which
+// case that task is returned instead
+func (self *Server) claimKey(key string, rec *taskRecord) *taskRecord {
+    self.keyLock.Lock()
+    defer self.keyLock.Unlock()
+
+    self.expireKeys(time.Now())
+    keyed, ok := self.keys[key]
+    if ok {
+        return keyed.record
+    }
+    self.keys[key] = &keyedTask{key: key, record: rec}
+    return nil
+}
+
+// must hold keyLock. forget keys whose windows have passed. the window is
+// the same for every key, so they expire in the order their tasks ended
+func (self *Server) expireKeys(now time.Time) {
+    for len(self.expiringKeys) > 0 && now.After(self.expiringKeys[0].expires) {
+        keyed := self.expiringKeys[0]
+        self.expiringKeys[0] = nil
+        self.expiringKeys = self.expiringKeys[1:]
+        if self.keys[keyed.key] == keyed {
+            delete(self.keys, keyed.key)
+        }
+    }
+}
+
+// forget keys whose windows have passed by now. returns when the next
+// window passes, zero if no key is counting down
+func (self *Server) sweepKeys(now time.Time) time.Time {
+    self.keyLock.Lock()
+    defer self.keyLock.Unlock()
+
+    self.expireKeys(now)
+    if len(self.expiringKeys) == 0 {
+        return time.Time{}
+    }
+    return self.expiringKeys[0].expires
+}
+
+// rec is in line, so standbys can know its key
+func (self *Server) keyQueued(key string, rec *taskRecord) {
+    self.keyLock.Lock()
+    keyed, ok := self.keys[key]
+    ok = ok && keyed.record == rec
+    if ok {
+        keyed.id = rec.id
+    }
+    self.keyLock.Unlock()
+
+    if ok {
+        self.journal.emit(journalEntry{Kind: journalKey, Key: key, TaskId: rec.id})
+    }
+}
+
+// rec has ended with final, start its key's retention window
+func (self *Server) releaseKey(key string, rec *taskRecord, final Task) {
+    self.keyLock.Lock()
+    keyed, ok := self.keys[key]
+    ok = ok && keyed.record == rec && keyed.expires.IsZero()
+    if ok {
+        keyed.expires = time.Now().Add(self.IdempotencyWindow)
+        keyed.final = final
+        self.expiringKeys = append(self.expiringKeys, keyed)
+    }
+    // the window is the same for every key, so only the first one to
+    // start is the soonest to expire
+    first := ok && len(self.expiringKeys) == 1
+    self.keyLock.Unlock()
+
+    if first {
+        self.wakeScheduler()
+    }
+    if ok {
+        self.journal.emit(journalEntry{Kind: journalKey, Key: key, TaskId: rec.id, Task: final, Expires: keyed.expires})
+    }
+}
+
+// take on the keys replicated from the server we took over from. keys of
+// tasks which are still going go with their restored records, and keys of
+// ended ones with a stand-in which only knows how the task ended
+func (self *Server) restoreKeys(keys map[string]journalEntry) {
+    var live, ended []*keyedTask
+    now := time.Now()
+
+    for key, entry := range keys {
+        if entry.Expires.IsZero() {
+            self.taskLock.Lock()
+            rec, ok := self.tasks[entry.TaskId]
+            self.taskLock.Unlock()
+            if ok {
+                rec.lock.Lock()
+                rec.key = key
+                rec.lock.Unlock()
+                live = append(live, &keyedTask{key: key, id: rec.id, record: rec})
+            }
+        } else if now.Before(entry.Expires) {
+            rec := &taskRecord{id: entry.TaskId, ended: true, final: entry.Task}
+            ended = append(ended, &keyedTask{key: key, id: rec.id, record: rec, expires: entry.Expires, final: entry.Task})
+        }
+    }
+    sort.Slice(ended, func(i, j int) bool {
+        return ended[i].expires.Before(ended[j].expires)
+    })
+
+    self.keyLock.Lock()
+    defer self.keyLock.Unlock()
+
+    for _, keyed := range append(live, ended...) {
+        self.keys[keyed.key] = keyed
+    }
+    self.expiringKeys = append(ended, self.expiringKeys...)
+    if len(ended) > 0 {
+        self.wakeScheduler()
+    }
+}
+
+// rec never made it into the queue, forget it
+func (self *Server) dropKey(key string, rec *taskRecord) {
+    self.keyLock.Lock()
+    defer self.keyLock.Unlock()
+
+    keyed, ok := self.keys[key]
+    if ok && keyed.record == rec {
+        delete(self.keys, key)
+    }
+}
@@ -0,0 +1,122 @@
+package silk
+
+import (
+    "os"
+    "time"
+    "strings"
+    "path/filepath"
+)
+
+// how many departed nodes the server remembers by Identity
+const departedLimit = 1000
+
+// read the node's identity from path, generating and saving one there if
+// there isn't one yet
+func loadIdentity(path string) (string, error) {
+    data, err := os.ReadFile(path)
+    if err == nil {
+        identity := strings.TrimSpace(string(data))
+        if identity != "" {
+            return identity, nil
+        }
+    } else if !os.IsNotExist(err) {
+        return "", err
+    }
+
+    identity := randomId(16)
+    err = os.MkdirAll(filepath.Dir(path), 0755)
+    if err != nil {
+        return "", err
+    }
+    // write then rename so a crash can't leave a half written identity
+    tmp := path + ".tmp"
+    err = os.WriteFile(tmp, []byte(identity + "\n"), 0644)
+    if err != nil {
+        return "", err
+    }
+    return identity, os.Rename(tmp, path)
+}
+
+// the id a node with this identity had before, and whether it's still being
+// tracked under it
+func (self *Server) knownNode(identity string) (int, bool, bool) {
+    if identity == "" {
+        return -1, false, false
+    }
+
+    self.nodeLock.Lock()
+    defer self.nodeLock.Unlock()
+
+    id, known := self.identities[identity]
+    _, live := self.nodeDeadlines[id]
+    return id, known, known && live
+}
+
+// must hold nodeLock. remember a node that went away so it can come back
+// under the same id. the oldest ones are forgotten past departedLimit
+func (self *Server) depart(node *NodeStatus) {
+    if node.Caps.Identity == "" {
+        return
+    }
+    self.departed[node.Id] = *node
+
+    if len(self.departed) > departedLimit {
+        oldest := -1
+        for id, other := range self.departed {
+            if oldest == -1 || other.LastSeen.Before(self.departed[oldest].LastSeen) {
+                oldest = id
+            }
+        }
+        delete(self.identities, self.departed[oldest].Caps.Identity)
+        delete(self.departed, oldest)
+    }
+}
+
+// a node we're still tracking came back without its task, e.g. it restarted
+// before it timed out. take on its new caps and put its task back in line
+func (self *Server) rejoinNode(id int, caps ClientCaps, addr string) {
+    self.nodeLock.Lock()
+    node := self.nodes[id]
+    if len(caps.Labels) == 0 {
+        caps.Labels = node.Caps.Labels
+    }
+    caps.Labels = nodeLabels(caps, addr)
+    node.Caps = caps
+    node.Addr = addr
+    node.LastSeen = time.Now()
+    node.Rejoins++
+    lostTask := node.TaskId
+    node.TaskId = -1
+    self.nodeLock.Unlock()
+
+    self.events.emit(EventNodeRejoined, id, lostTask, addr)
+    self.journal.emit(journalEntry{Kind: journalNode, NodeId: id, Caps: caps, Addr: addr})
+
+    self.nodeLost(id, lostTask)
+}
+
+// a node which timed out came back still running a task. if nobody else has
+// picked the task up in the meantime, hand it back to the node
+func (self *Server) reclaimTask(id int, nodeId int) bool {
+    self.nodeLock.Lock()
+    var labels map[string]string
+    poolName := DefaultPool
+    if node, ok := self.nodes[nodeId]; ok {
+        labels = node.Caps.Labels
+        poolName = node.Caps.Pool
+    }
+    self.nodeLock.Unlock()
+
+    self.taskLock.Lock()
+    rec, ok := self.tasks[id]
+    self.taskLock.Unlock()
+    if !ok || rec.pool.name != poolName {
+        return false
+    }
+
+    if !rec.pool.queue.reclaim(id, labels) {
+        return false
+    }
+    self.taskDispatched(id, nodeId)
+    return true
+}
@@ -0,0 +1,201 @@
+package silk
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "time"
+    "os/exec"
+    "strconv"
+    "encoding/gob"
+)
+
+// environment variables used to hand configuration to an isolated child
+const isolateEnv = "SILK_ISOLATED_TASK"
+const memLimitEnv = "SILK_TASK_MEM_MB"
+const cpuTimeEnv = "SILK_TASK_CPU_SECONDS"
+
+// the child gets the task on stdin and writes checkpoints to this fd
+const checkpointFd = 3
+
+// how much of a crashed child's stderr makes it into the failure report
+const stderrTail = 4096
+
+// Programs which run a Client with Isolate set must call this first thing in
+// main(). In the parent it returns immediately. In a child process it runs
+// the task it was handed and exits, never returning.
+func RunIsolatedChild() {
+    if os.Getenv(isolateEnv) == "" {
+        return
+    }
+
+    memMB, _ := strconv.Atoi(os.Getenv(memLimitEnv))
+    cpuSeconds, _ := strconv.Atoi(os.Getenv(cpuTimeEnv))
+    err := setTaskRlimits(memMB, cpuSeconds)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "silk: could not apply task limits: %s\n", err.Error())
+        os.Exit(2)
+    }
+
+    var t Task
+    err = gob.NewDecoder(os.Stdin).Decode(&t)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "silk: could not decode task: %s\n", err.Error())
+        os.Exit(2)
+    }
+
+    out := os.NewFile(checkpointFd, "checkpoints")
+    e := gob.NewEncoder(out)
+
+    progress := make(chan Task)
+    cancel := make(chan bool)
+    returned := make(chan bool)
+    go func() {
+        t.Run(progress, cancel)
+        close(returned)
+    }()
+
+    for {
+        var checkpoint Task
+        select {
+        case checkpoint = <-progress:
+        case <-returned:
+            // nothing more is coming, the parent reports it as a crash
+            fmt.Fprintf(os.Stderr, "silk: task returned without finishing\n")
+            os.Exit(2)
+        }
+        err = e.Encode(&checkpoint)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "silk: could not encode checkpoint: %s\n", err.Error())
+            os.Exit(2)
+        }
+        if checkpoint.IsDone() {
+            os.Exit(0)
+        }
+    }
+}
+
+// parent side of an isolated task. re-executes our own binary, feeds it the
+// task and relays checkpoints. a child which dies without finishing its task
+// is reported on failed. closing cancel kills the child. meter is told
+// about the child so it can measure it
+func (self *Client) runIsolated(t Task, meter *taskMeter, progress chan Task, failed chan string, cancel chan bool) {
+    exe, err := os.Executable()
+    if err != nil {
+        failed <- fmt.Sprintf("could not locate own binary: %s", err.Error())
+        return
+    }
+
+    checkpointsR, checkpointsW, err := os.Pipe()
+    if err != nil {
+        failed <- fmt.Sprintf("could not create checkpoint pipe: %s", err.Error())
+        return
+    }
+
+    stderr := &tailBuffer{limit: stderrTail}
+    start := func(group *taskCgroup) (*exec.Cmd, io.WriteCloser, error) {
+        cmd := exec.Command(exe, os.Args[1:]...)
+        cmd.Env = append(os.Environ(),
+            isolateEnv + "=1",
+            fmt.Sprintf("%s=%d", memLimitEnv, self.TaskMemLimitMB),
+            fmt.Sprintf("%s=%d", cpuTimeEnv, int((self.TaskCpuTime + time.Second - 1) / time.Second)),
+        )
+        cmd.Stdout = os.Stdout
+        cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+        cmd.ExtraFiles = []*os.File{checkpointsW}
+        group.attach(cmd)
+        stdin, err := cmd.StdinPipe()
+        if err != nil {
+            return nil, nil, err
+        }
+        return cmd, stdin, cmd.Start()
+    }
+
+    // rlimits apply either way, TaskCpus only with the group
+    group, err := newTaskCgroup(self.TaskMemLimitMB, self.TaskCpus)
+    if err != nil {
+        self.log.Warn("could not make a cgroup for isolated task", "error", err)
+    }
+    cmd, stdin, err := start(group)
+    if err != nil && group != nil {
+        // e.g. a kernel older than 5.7 can't start a process in a cgroup
+        self.log.Warn("could not start isolated task in its cgroup, starting it without", "error", err)
+        group.leave()
+        group = nil
+        cmd, stdin, err = start(nil)
+    }
+    checkpointsW.Close()
+    if err != nil {
+        checkpointsR.Close()
+        failed <- fmt.Sprintf("could not start child: %s", err.Error())
+        return
+    }
+    meter.child(cmd.Process.Pid)
+
+    exited := make(chan bool)
+    go func() {
+        select {
+        case <-cancel:
+            cmd.Process.Kill()
+        case <-exited:
+        }
+    }()
+
+    e := gob.NewEncoder(stdin)
+    err = e.Encode(&t)
+    stdin.Close()
+
+    done := false
+    d := gob.NewDecoder(checkpointsR)
+    for err == nil {
+        var checkpoint Task
+        err = d.Decode(&checkpoint)
+        if err != nil {
+            break
+        }
+
+        select {
+        case progress <- checkpoint:
+        case <-cancel:
+        }
+        done = checkpoint.IsDone()
+    }
+
+    err = cmd.Wait()
+    meter.exited(cmd.ProcessState)
+    close(exited)
+    checkpointsR.Close()
+    group.leave()
+
+    select {
+    case <-cancel:
+        // we killed it ourselves
+        return
+    default:
+    }
+
+    if !done {
+        if err == nil {
+            err = fmt.Errorf("exited before finishing its task")
+        }
+        failed <- fmt.Sprintf("isolated task died: %s\n%s", err.Error(), stderr.String())
+    }
+}
+
+// keeps only the last limit bytes written to it
+type tailBuffer struct {
+    limit int
+    data []byte
+}
+
+func (self *tailBuffer) Write(p []byte) (int, error) {
+    self.data = append(self.data, p...)
+    if len(self.data) > self.limit {
+        self.data = self.data[len(self.data) - self.limit:]
+    }
+    return len(p), nil
+}
+
+func (self *tailBuffer) String() string {
+    return string(self.data)
+}
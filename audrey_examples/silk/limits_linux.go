@@ -0,0 +1,117 @@
+package silk
+
+import (
+    "os"
+    "fmt"
+    "os/exec"
+    "strings"
+    "syscall"
+    "io/ioutil"
+    "sync/atomic"
+    "path/filepath"
+)
+
+// called in an isolated child before it touches its task
+func setTaskRlimits(memMB int, cpuSeconds int) error {
+    if memMB > 0 {
+        limit := uint64(memMB) << 20
+        err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limit, Max: limit})
+        if err != nil {
+            return err
+        }
+    }
+    if cpuSeconds > 0 {
+        limit := uint64(cpuSeconds)
+        err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: limit, Max: limit})
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// a cgroup v2 group made for one isolated child, underneath ours
+type taskCgroup struct {
+    dir *os.File // open so the child can be started in it
+}
+
+// tells the groups of the isolated children we start apart
+var taskCgroupCount uint64
+
+// best effort: make a group with the child's limits for it to start in, so
+// it's limited from its first allocation. returns nil if cgroups v2 aren't
+// available to us, and an error if the group's limits couldn't be set
+func newTaskCgroup(memMB int, cpus int) (*taskCgroup, error) {
+    if memMB <= 0 && cpus <= 0 {
+        return nil, nil
+    }
+
+    self, err := ioutil.ReadFile("/proc/self/cgroup")
+    if err != nil {
+        return nil, nil
+    }
+    var parent string
+    for _, line := range strings.Split(string(self), "\n") {
+        if strings.HasPrefix(line, "0::") {
+            parent = strings.TrimPrefix(line, "0::")
+        }
+    }
+    if parent == "" {
+        // not a cgroups v2 system
+        return nil, nil
+    }
+
+    root := filepath.Join("/sys/fs/cgroup", parent)
+    _, err = os.Stat(filepath.Join(root, "cgroup.controllers"))
+    if err != nil {
+        // cgroups v2 isn't mounted there, e.g. a hybrid system
+        return nil, nil
+    }
+
+    name := fmt.Sprintf("silk-task-%d-%d", os.Getpid(), atomic.AddUint64(&taskCgroupCount, 1))
+    path := filepath.Join(root, name)
+    err = os.Mkdir(path, 0755)
+    if err != nil {
+        return nil, nil
+    }
+
+    // e.g. the controller isn't enabled in our group's cgroup.subtree_control
+    if memMB > 0 {
+        err = ioutil.WriteFile(filepath.Join(path, "memory.max"), []byte(fmt.Sprintf("%d", memMB << 20)), 0644)
+        if err != nil {
+            os.Remove(path)
+            return nil, fmt.Errorf("could not set memory.max: %w", err)
+        }
+    }
+    if cpus > 0 {
+        err = ioutil.WriteFile(filepath.Join(path, "cpu.max"), []byte(fmt.Sprintf("%d 100000", cpus * 100000)), 0644)
+        if err != nil {
+            os.Remove(path)
+            return nil, fmt.Errorf("could not set cpu.max: %w", err)
+        }
+    }
+
+    dir, err := os.Open(path)
+    if err != nil {
+        os.Remove(path)
+        return nil, err
+    }
+    return &taskCgroup{dir}, nil
+}
+
+// have cmd start in the group rather than join it once it's running
+func (self *taskCgroup) attach(cmd *exec.Cmd) {
+    if self == nil {
+        return
+    }
+    cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(self.dir.Fd())}
+}
+
+// the child must have exited by now
+func (self *taskCgroup) leave() {
+    if self == nil {
+        return
+    }
+    os.Remove(self.dir.Name())
+    self.dir.Close()
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package silk
+
+import (
+    "errors"
+    "os/exec"
+)
+
+func setTaskRlimits(memMB int, cpuSeconds int) error {
+    if memMB > 0 || cpuSeconds > 0 {
+        return errors.New("task limits are only supported on linux")
+    }
+    return nil
+}
+
+type taskCgroup struct{}
+
+func newTaskCgroup(memMB int, cpus int) (*taskCgroup, error) {
+    return nil, nil
+}
+
+func (self *taskCgroup) attach(cmd *exec.Cmd) {
+}
+
+func (self *taskCgroup) leave() {
+}
@@ -0,0 +1,34 @@
+package silk
+
+import (
+    "log/slog"
+)
+
+// attribute keys used in every log line, so logs from servers and clients
+// can be filtered and joined on them
+const (
+    logServerId = "server_id"
+    logNodeId = "node_id"
+    logTaskId = "task_id"
+    logRemoteAddr = "remote_addr"
+)
+
+// routine protocol decisions, like heartbeats and dispatches, are logged at
+// debug level, nodes coming and going and tasks ending at info, and anything
+// which loses work or looks like a bug at warn or error
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+    if logger == nil {
+        return slog.Default()
+    }
+    return logger
+}
+
+// the server's logger, which tags every line with its ServerId
+func (self *Server) log() *slog.Logger {
+    return self.logger.Load()
+}
+
+// the ServerId changed, e.g. on takeover
+func (self *Server) relog() {
+    self.logger.Store(loggerOrDefault(self.Logger).With(logServerId, self.currentServerId()))
+}
@@ -0,0 +1,81 @@
+package silk
+
+import (
+    "net"
+)
+
+// label the server gives every node, the host part of its address, unless
+// the node reports one itself
+const HostLabel = "silk.host"
+
+// where a task may, and would rather, run. nodes report their labels in
+// ClientCaps.Labels
+type Placement struct {
+    Require map[string]string // only nodes with all of these labels
+    Avoid map[string]string // never nodes with any of these labels
+
+    // a node takes the queued task which prefers the most of its labels,
+    // among its tenant's tasks of the highest priority it can run
+    Prefer map[string]string
+
+    // tasks in the same SpreadGroup never run at once on nodes with the same
+    // value of the SpreadBy label, HostLabel by default. e.g. shards of one
+    // job with SpreadGroup set to the job's name never share a machine
+    SpreadGroup string
+    SpreadBy string
+}
+
+// the labels the server goes by for a node
+func nodeLabels(caps ClientCaps, addr string) map[string]string {
+    labels := make(map[string]string)
+    for k, v := range caps.Labels {
+        labels[k] = v
+    }
+    if _, ok := labels[HostLabel]; !ok {
+        host, _, err := net.SplitHostPort(addr)
+        if err != nil {
+            host = addr
+        }
+        labels[HostLabel] = host
+    }
+    return labels
+}
+
+// can a node with these labels run the task at all, ignoring spreading
+func (self Placement) allows(labels map[string]string) bool {
+    for k, v := range self.Require {
+        if labels[k] != v {
+            return false
+        }
+    }
+    for k, v := range self.Avoid {
+        if have, ok := labels[k]; ok && have == v {
+            return false
+        }
+    }
+    return true
+}
+
+// how many preferred labels a node has
+func (self Placement) preference(labels map[string]string) int {
+    score := 0
+    for k, v := range self.Prefer {
+        if have, ok := labels[k]; ok && have == v {
+            score++
+        }
+    }
+    return score
+}
+
+// what a task running on a node with these labels counts against in its
+// spread group, "" if it isn't spread
+func (self Placement) spreadKey(labels map[string]string) string {
+    if self.SpreadGroup == "" {
+        return ""
+    }
+    by := self.SpreadBy
+    if by == "" {
+        by = HostLabel
+    }
+    return self.SpreadGroup + "\x00" + labels[by]
+}
@@ -0,0 +1,123 @@
+package silk
+
+import (
+    "fmt"
+    "sort"
+    "time"
+)
+
+// the pool nodes join and tasks are submitted to unless they name another.
+// it's configured by the Server's own fields
+const DefaultPool = ""
+
+// settings for a named pool. a Version or NodeTimeout of 0 means the
+// Server's. the rest don't fall back: nil Tenants gives every tenant the
+// defaults, and a QueueCapacity of 0 is unbounded
+type PoolConfig struct {
+    Version int
+    NodeTimeout time.Duration
+    Tenants map[string]TenantConfig
+    QueueCapacity int
+    Admission AdmissionPolicy
+}
+
+// a set of nodes working through a queue of tasks of their own
+type pool struct {
+    name string
+    config PoolConfig
+    queue *taskQueue
+}
+
+// what a pool has been up to
+type PoolStatus struct {
+    Name string
+    Version int
+    NodeTimeout time.Duration
+    Nodes int
+    Queued int
+    Running int
+    Tenants map[string]TenantUsage
+}
+
+// set up the default pool and the configured ones. they don't change after
+// Serve, so self.pools needs no lock
+func (self *Server) makePools() {
+    self.pools = make(map[string]*pool)
+    self.pools[DefaultPool] = &pool{DefaultPool, PoolConfig{self.Version, self.NodeTimeout, self.Tenants, self.QueueCapacity, self.Admission}, nil}
+    for name, config := range self.Pools {
+        if name == DefaultPool {
+            continue
+        }
+        if config.Version == 0 {
+            config.Version = self.Version
+        }
+        if config.NodeTimeout == 0 {
+            config.NodeTimeout = self.NodeTimeout
+        }
+        self.pools[name] = &pool{name, config, nil}
+    }
+
+    for _, p := range self.pools {
+        p.queue = newTaskQueue(p.config.Tenants, p.config.QueueCapacity, p.config.Admission)
+    }
+}
+
+func (self *Server) pool(name string) (*pool, error) {
+    p, ok := self.pools[name]
+    if !ok {
+        return nil, fmt.Errorf("no such pool %q", name)
+    }
+    return p, nil
+}
+
+// versions of the pools which differ from Version, for announcements
+func (self *Server) poolVersions() []int {
+    var versions []int
+    seen := map[int]bool{self.Version: true}
+    for _, p := range self.pools {
+        if !seen[p.config.Version] {
+            seen[p.config.Version] = true
+            versions = append(versions, p.config.Version)
+        }
+    }
+    sort.Ints(versions)
+    return versions
+}
+
+// every pool, by name
+func (self *Server) PoolUsage() []PoolStatus {
+    var result []PoolStatus
+    for _, p := range self.pools {
+        status := PoolStatus{Name: p.name, Version: p.config.Version, NodeTimeout: p.config.NodeTimeout}
+        status.Tenants = p.queue.usage()
+        for _, usage := range status.Tenants {
+            status.Queued += usage.Queued
+            status.Running += usage.Running
+        }
+        result = append(result, status)
+    }
+
+    self.nodeLock.Lock()
+    for _, node := range self.nodes {
+        for i := range result {
+            if result[i].Name == node.Caps.Pool {
+                result[i].Nodes++
+            }
+        }
+    }
+    self.nodeLock.Unlock()
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].Name < result[j].Name
+    })
+    return result
+}
+
+// what each tenant has submitted to pool and is running there, by tenant
+func (self *Server) PoolTenantUsage(name string) (map[string]TenantUsage, error) {
+    p, err := self.pool(name)
+    if err != nil {
+        return nil, err
+    }
+    return p.queue.usage(), nil
+}
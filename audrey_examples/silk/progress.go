@@ -0,0 +1,92 @@
+package silk
+
+import (
+    "time"
+)
+
+// tasks can implement this to say how far along they are, without callers
+// having to know their type. it's asked of every checkpoint
+type Progress interface {
+    Progress() TaskProgress
+}
+
+type TaskProgress struct {
+    Fraction float64 // done so far, 0 to 1. negative if the task can't tell
+    Stage string // e.g. "downloading", free form
+    Counters map[string]int64 // e.g. rows processed, free form
+}
+
+// how many of the latest progress reports an ETA is worked out from
+const etaWindow = 20
+
+type progressSample struct {
+    at time.Time
+    fraction float64
+}
+
+// progress of a checkpoint, nil if it doesn't implement Progress
+func progressOf(t Task) *TaskProgress {
+    p, ok := t.(Progress)
+    if !ok {
+        return nil
+    }
+    progress := p.Progress()
+    return &progress
+}
+
+// must hold taskLock. a node reported progress at the given time
+func (self *taskRecord) progressed(progress *TaskProgress, at time.Time) {
+    if progress == nil {
+        return
+    }
+    self.status.Progress = progress
+    if progress.Fraction < 0 {
+        return
+    }
+
+    self.progressHistory = append(self.progressHistory, progressSample{at, progress.Fraction})
+    if len(self.progressHistory) > etaWindow {
+        self.progressHistory = self.progressHistory[len(self.progressHistory) - etaWindow:]
+    }
+    self.status.ETA = estimate(self.progressHistory)
+}
+
+// must hold taskLock. the task's last node went away, and time spent queued
+// says nothing about how fast it runs
+func (self *taskRecord) progressReset() {
+    self.progressHistory = nil
+    self.status.ETA = time.Time{}
+}
+
+// when the task should be done if it keeps going at the rate it has over
+// samples. zero if there's no telling
+func estimate(samples []progressSample) time.Time {
+    if len(samples) < 2 {
+        return time.Time{}
+    }
+    first, last := samples[0], samples[len(samples) - 1]
+    done := last.fraction - first.fraction
+    elapsed := last.at.Sub(first.at)
+    if done <= 0 || elapsed <= 0 {
+        return time.Time{}
+    }
+
+    remaining := 1 - last.fraction
+    if remaining < 0 {
+        remaining = 0
+    }
+    return last.at.Add(time.Duration(remaining / done * float64(elapsed)))
+}
+
+// the task's latest progress and when it should be done, if it implements
+// Progress. the ETA is zero until it can be estimated
+func (self *Submission) Progress() (TaskProgress, time.Time, bool) {
+    if self.server == nil {
+        return TaskProgress{}, time.Time{}, false
+    }
+    status, _, ok := self.server.TaskInfo(self.Id)
+    if !ok || status.Progress == nil {
+        return TaskProgress{}, time.Time{}, false
+    }
+    return *status.Progress, status.ETA, true
+}
@@ -0,0 +1,437 @@
+package silk
+
+import (
+    "sync"
+    "errors"
+)
+
+// what to do with a submission when the queue is at capacity
+type AdmissionPolicy int
+
+const (
+    AdmitReject AdmissionPolicy = iota // fail the submission with ErrOverloaded
+    AdmitBlock // wait for room in the queue
+    AdmitShed // evict the lowest priority queued task, if it's lower than ours
+)
+
+var ErrOverloaded = errors.New("server task queue is full")
+
+// scheduling settings for one tenant
+type TenantConfig struct {
+    Weight int // share of the cluster relative to other tenants, default 1
+    MaxRunning int // quota on concurrently running tasks, 0 for unlimited
+}
+
+// what a tenant has been up to
+type TenantUsage struct {
+    Weight int
+    MaxRunning int
+    Queued int
+    Running int
+    Submitted int
+    Dispatched int // includes redispatches after node deaths
+    Finished int
+}
+
+const (
+    itemQueued = iota
+    itemRunning
+    itemEnded
+)
+
+// a task waiting for, or assigned to, a node
+type queueItem struct {
+    task taskWithId
+    tenant *tenantState
+    priority int
+    placement Placement
+    spreadKey string // set while running, if the task is spread
+    state int
+    taken chan bool // closed the first time a node picks the task up
+    ended chan bool // closed when the task is done with the queue for good
+    evicted bool // it ended because shed made room for another task
+}
+
+type tenantState struct {
+    config TenantConfig
+    queue []*queueItem
+    preferring int // queued tasks with Placement.Prefer set
+    usage TenantUsage
+    pass float64 // stride scheduling: grows by 1/weight per dispatch
+}
+
+// the server's pending work, split up by tenant
+// nodes are handed tasks from whichever tenant with spare quota currently has
+// the smallest share of the running tasks relative to its weight
+// within a tenant, higher priority tasks go first
+type taskQueue struct {
+    lock sync.Mutex
+    space *sync.Cond // signalled whenever a task leaves the queue
+    configs map[string]TenantConfig
+    tenants map[string]*tenantState
+
+    capacity int // 0 for unbounded
+    policy AdmissionPolicy
+    queued int
+
+    spread map[string]int // running tasks by Placement.spreadKey
+}
+
+func newTaskQueue(configs map[string]TenantConfig, capacity int, policy AdmissionPolicy) *taskQueue {
+    self := &taskQueue{
+        configs: configs,
+        tenants: make(map[string]*tenantState),
+        capacity: capacity,
+        policy: policy,
+        spread: make(map[string]int),
+    }
+    self.space = sync.NewCond(&self.lock)
+    return self
+}
+
+// must hold lock
+func (self *taskQueue) tenant(name string) *tenantState {
+    tenant, ok := self.tenants[name]
+    if !ok {
+        config := self.configs[name]
+        if config.Weight <= 0 {
+            config.Weight = 1
+        }
+        tenant = &tenantState{config: config}
+        tenant.usage.Weight = config.Weight
+        tenant.usage.MaxRunning = config.MaxRunning
+        self.tenants[name] = tenant
+    }
+    return tenant
+}
+
+// must hold lock
+func (self *taskQueue) enqueue(item *queueItem, front bool) {
+    tenant := item.tenant
+    if len(tenant.queue) == 0 {
+        // don't let a tenant which was idle bank credit. catch it up with
+        // the least served busy tenant
+        min := -1.0
+        for _, other := range self.tenants {
+            if len(other.queue) > 0 && (min < 0 || other.pass < min) {
+                min = other.pass
+            }
+        }
+        if min > tenant.pass {
+            tenant.pass = min
+        }
+    }
+
+    item.state = itemQueued
+    if len(item.placement.Prefer) > 0 {
+        tenant.preferring++
+    }
+    if front {
+        tenant.queue = append([]*queueItem{item}, tenant.queue...)
+    } else {
+        i := len(tenant.queue)
+        for i > 0 && tenant.queue[i-1].priority < item.priority {
+            i--
+        }
+        tenant.queue = append(tenant.queue, nil)
+        copy(tenant.queue[i+1:], tenant.queue[i:])
+        tenant.queue[i] = item
+    }
+    tenant.usage.Queued++
+    self.queued++
+}
+
+// must hold lock
+func (self *taskQueue) unqueue(item *queueItem) {
+    tenant := item.tenant
+    for i, other := range tenant.queue {
+        if other == item {
+            self.remove(tenant, i)
+            return
+        }
+    }
+}
+
+// must hold lock. take the i'th task out of tenant's queue
+func (self *taskQueue) remove(tenant *tenantState, i int) {
+    item := tenant.queue[i]
+    if i == 0 {
+        // the usual case. don't shift the whole queue along
+        tenant.queue[0] = nil
+        tenant.queue = tenant.queue[1:]
+    } else {
+        tenant.queue = append(tenant.queue[:i], tenant.queue[i+1:]...)
+    }
+    if len(item.placement.Prefer) > 0 {
+        tenant.preferring--
+    }
+    tenant.usage.Queued--
+    self.queued--
+    self.space.Signal()
+}
+
+// must hold lock
+func (self *taskQueue) release(item *queueItem) {
+    if item.state == itemRunning {
+        item.tenant.usage.Running--
+        if item.spreadKey != "" {
+            self.spread[item.spreadKey]--
+            if self.spread[item.spreadKey] == 0 {
+                delete(self.spread, item.spreadKey)
+            }
+            item.spreadKey = ""
+        }
+    }
+}
+
+// must hold lock. mark item as running on a node with these labels
+func (self *taskQueue) run(item *queueItem, labels map[string]string) {
+    item.state = itemRunning
+    item.tenant.usage.Running++
+    item.spreadKey = item.placement.spreadKey(labels)
+    if item.spreadKey != "" {
+        self.spread[item.spreadKey]++
+    }
+}
+
+// must hold lock. which of tenant's queued tasks a node with these labels
+// should take, -1 if it can't run any of them. only the highest priority
+// tasks the node can run are considered, and of those the one which prefers
+// the node most, then the one which has waited longest
+func (self *taskQueue) pick(tenant *tenantState, labels map[string]string) int {
+    best := -1
+    bestScore := -1
+    for i, item := range tenant.queue {
+        if best != -1 && item.priority < tenant.queue[best].priority {
+            break
+        }
+        if !item.placement.allows(labels) {
+            continue
+        }
+        if key := item.placement.spreadKey(labels); key != "" && self.spread[key] > 0 {
+            continue
+        }
+        score := item.placement.preference(labels)
+        if score > bestScore {
+            best = i
+            bestScore = score
+            if tenant.preferring == 0 {
+                // nothing further back can beat it
+                break
+            }
+        }
+    }
+    return best
+}
+
+// admit a new task, subject to capacity. also returns the task which was
+// evicted to make room for it, if any
+func (self *taskQueue) push(task taskWithId, tenant string, priority int, placement Placement) (*queueItem, *queueItem, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    var evicted *queueItem
+    for self.capacity > 0 && self.queued >= self.capacity {
+        if self.policy == AdmitBlock {
+            self.space.Wait()
+            continue
+        }
+        if self.policy == AdmitShed {
+            evicted = self.shed(priority)
+        }
+        if evicted == nil {
+            return nil, nil, ErrOverloaded
+        }
+        break
+    }
+
+    item := &queueItem{
+        task: task,
+        tenant: self.tenant(tenant),
+        priority: priority,
+        placement: placement,
+        taken: make(chan bool),
+        ended: make(chan bool),
+    }
+    item.tenant.usage.Submitted++
+    self.enqueue(item, false)
+    return item, evicted, nil
+}
+
+// must hold lock. evict the lowest priority queued task if it has a lower
+// priority than the one we want to admit, and return it. tasks which have
+// already been on a node and are waiting to resume are never evicted
+func (self *taskQueue) shed(priority int) *queueItem {
+    var victim *queueItem
+    for _, tenant := range self.tenants {
+        for _, item := range tenant.queue {
+            if item.priority >= priority {
+                continue
+            }
+            select {
+            case <-item.taken:
+                continue
+            default:
+            }
+            if victim == nil || item.priority <= victim.priority {
+                victim = item
+            }
+        }
+    }
+    if victim == nil {
+        return nil
+    }
+
+    self.unqueue(victim)
+    victim.evicted = true
+    self.end(victim)
+    return victim
+}
+
+// must hold lock. wakes anyone waiting for the task to be taken, who'd
+// otherwise wait forever
+func (self *taskQueue) end(item *queueItem) {
+    if item.state != itemEnded {
+        item.state = itemEnded
+        close(item.ended)
+    }
+}
+
+// put back a task replicated from another server, bypassing capacity.
+// tasks running on a node, whose labels are given, are counted as already
+// dispatched to it. labels is nil for queued tasks
+func (self *taskQueue) restore(task taskWithId, tenant string, priority int, placement Placement, labels map[string]string) *queueItem {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    item := &queueItem{
+        task: task,
+        tenant: self.tenant(tenant),
+        priority: priority,
+        placement: placement,
+        taken: make(chan bool),
+        ended: make(chan bool),
+    }
+    item.tenant.usage.Submitted++
+    if labels != nil {
+        close(item.taken)
+        self.run(item, labels)
+        item.tenant.usage.Dispatched++
+    } else {
+        self.enqueue(item, false)
+    }
+    return item
+}
+
+// hand a node with these labels the next task according to fair share,
+// among the tasks it's allowed to run, if there is one
+func (self *taskQueue) pop(labels map[string]string) (taskWithId, bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    var best *tenantState
+    var bestShare float64
+    bestIndex := -1
+    for _, tenant := range self.tenants {
+        if len(tenant.queue) == 0 {
+            continue
+        }
+        if tenant.config.MaxRunning > 0 && tenant.usage.Running >= tenant.config.MaxRunning {
+            continue
+        }
+
+        share := float64(tenant.usage.Running) / float64(tenant.config.Weight)
+        if best == nil || share < bestShare || (share == bestShare && tenant.pass < best.pass) {
+            i := self.pick(tenant, labels)
+            if i == -1 {
+                continue
+            }
+            best = tenant
+            bestShare = share
+            bestIndex = i
+        }
+    }
+    if best == nil {
+        return taskWithId{-1, nil}, false
+    }
+
+    item := best.queue[bestIndex]
+    self.remove(best, bestIndex)
+    best.pass += 1 / float64(best.config.Weight)
+    best.usage.Dispatched++
+
+    select {
+    case <-item.taken:
+    default:
+        close(item.taken)
+    }
+    self.run(item, labels)
+    return item.task, true
+}
+
+// the node running item went away. put it back in line, ahead of its
+// tenant's other tasks, to resume from checkpoint
+func (self *taskQueue) requeue(item *queueItem, checkpoint Task) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if item.state != itemRunning {
+        return
+    }
+    self.release(item)
+    item.task.Task = checkpoint
+    self.enqueue(item, true)
+}
+
+// a node which went away came back with task id. if the task is still
+// waiting to resume, take it out of line as running on that node again
+func (self *taskQueue) reclaim(id int, labels map[string]string) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    for _, tenant := range self.tenants {
+        for _, item := range tenant.queue {
+            if item.task.TaskId == id {
+                self.unqueue(item)
+                tenant.usage.Dispatched++
+                self.run(item, labels)
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// item finished, failed or was cancelled
+func (self *taskQueue) finish(item *queueItem) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    switch item.state {
+    case itemQueued:
+        self.unqueue(item)
+    case itemRunning:
+        self.release(item)
+        item.tenant.usage.Finished++
+    }
+    self.end(item)
+}
+
+// number of tasks waiting for a node
+func (self *taskQueue) depth() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.queued
+}
+
+func (self *taskQueue) usage() map[string]TenantUsage {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    result := make(map[string]TenantUsage)
+    for name, tenant := range self.tenants {
+        result[name] = tenant.usage
+    }
+    return result
+}
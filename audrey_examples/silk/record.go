@@ -0,0 +1,177 @@
+package silk
+
+import (
+    "os"
+    "fmt"
+    "net"
+    "sync"
+    "time"
+    "bufio"
+    "errors"
+    "net/http"
+    "encoding/json"
+)
+
+// a task as it appears in a recording. tasks themselves aren't recorded,
+// only enough to replay what the scheduler saw of them
+type TaskRef struct {
+    Id int
+    Type string // "" if only the id went over the wire
+    Done bool
+}
+
+func taskRef(t taskWithId) *TaskRef {
+    ref := &TaskRef{Id: t.TaskId}
+    if t.Task != nil {
+        ref.Type = fmt.Sprintf("%T", t.Task)
+        ref.Done = t.Task.IsDone()
+    }
+    return ref
+}
+
+// one line of a RecordFile, which is json, one record per line
+type SyncRecord struct {
+    Kind string // "submit", "cancel" or "sync"
+    Time time.Time
+
+    // submit and cancel
+    TaskId int
+    Task *TaskRef
+    Tenant string
+    Pool string
+    Priority int
+    Placement Placement
+
+    // sync. Reported and Sent are nil if no task went that way, and
+    // Response is nil if the request was rejected with Status
+    RemoteAddr string
+    Request *SyncRequest
+    Reported *TaskRef
+    Response *SyncResponse
+    Sent *TaskRef
+    Status int
+    Took time.Duration
+}
+
+// appends SyncRecords to the RecordFile
+type recorder struct {
+    lock sync.Mutex
+    file *os.File
+    encoder *json.Encoder
+}
+
+func newRecorder(path string) (*recorder, error) {
+    f, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &recorder{file: f, encoder: json.NewEncoder(f)}, nil
+}
+
+// a nil recorder records nothing
+func (self *recorder) record(rec SyncRecord) {
+    if self == nil {
+        return
+    }
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.encoder.Encode(rec)
+}
+
+func (self *recorder) submitted(id int, t Task, opts TaskOptions) {
+    self.record(SyncRecord{
+        Kind: "submit",
+        Time: time.Now(),
+        TaskId: id,
+        Task: taskRef(taskWithId{id, t}),
+        Tenant: opts.Tenant,
+        Pool: opts.Pool,
+        Priority: opts.Priority,
+        Placement: opts.Placement,
+    })
+}
+
+func (self *recorder) cancelled(id int) {
+    self.record(SyncRecord{Kind: "cancel", Time: time.Now(), TaskId: id})
+}
+
+// one /sync exchange, filled in as ServeHTTP goes and recorded when it's done
+type syncRecording struct {
+    recorder *recorder
+    rec SyncRecord
+    w *statusWriter
+}
+
+// start recording an exchange. w is what ServeHTTP should write to from
+// here on
+func (self *recorder) startSync(w http.ResponseWriter, r *http.Request) (*syncRecording, http.ResponseWriter) {
+    if self == nil {
+        return nil, w
+    }
+    status := &statusWriter{ResponseWriter: w, status: 200}
+    return &syncRecording{self, SyncRecord{Kind: "sync", Time: time.Now(), RemoteAddr: r.RemoteAddr}, status}, status
+}
+
+// req is nil if the request couldn't be decoded, resp if no reply was made
+func (self *syncRecording) finish(req *SyncRequest, reported *taskWithId, resp *SyncResponse, sent *taskWithId) {
+    if self == nil {
+        return
+    }
+
+    self.rec.Took = time.Since(self.rec.Time)
+    self.rec.Status = self.w.status
+    self.rec.Request = req
+    if reported != nil {
+        self.rec.Reported = taskRef(*reported)
+    }
+    if self.rec.Status < 400 && resp != nil {
+        self.rec.Response = resp
+        if sent != nil {
+            self.rec.Sent = taskRef(*sent)
+        }
+    }
+    self.recorder.record(self.rec)
+}
+
+// notes the status ServeHTTP replies with
+type statusWriter struct {
+    http.ResponseWriter
+    status int
+}
+
+func (self *statusWriter) WriteHeader(status int) {
+    self.status = status
+    self.ResponseWriter.WriteHeader(status)
+}
+
+// so Chaos can still hang up
+func (self *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    hijacker, ok := self.ResponseWriter.(http.Hijacker)
+    if !ok {
+        return nil, nil, errors.New("can't hijack")
+    }
+    return hijacker.Hijack()
+}
+
+// read back a RecordFile
+func ReadRecording(path string) ([]SyncRecord, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var records []SyncRecord
+    d := json.NewDecoder(f)
+    for d.More() {
+        var rec SyncRecord
+        err = d.Decode(&rec)
+        if err != nil {
+            return records, err
+        }
+        records = append(records, rec)
+    }
+    return records, nil
+}
@@ -0,0 +1,121 @@
+package silk
+
+import (
+    "sync"
+    "time"
+)
+
+// how an ended task turned out, kept after the task is gone from Tasks()
+type TaskResult struct {
+    Id int
+    Type string
+    Tenant string
+    State string // TaskDone, TaskFailedState or TaskCancelled
+    Final Task // the last checkpoint, nil if there was none
+    Failure string
+    Submitted time.Time
+    Ended time.Time
+    Usage ResourceUsage
+}
+
+// where the results of ended tasks are kept for Server.Result. how long
+// they're kept is up to the store. must be safe for concurrent use
+type ResultStore interface {
+    SaveResult(result TaskResult) error
+    LoadResult(id int) (TaskResult, bool, error)
+}
+
+// the default ResultStore. keeps results in memory for Retention, and no
+// more than Limit of them
+type memoryResults struct {
+    Retention time.Duration
+    Limit int
+
+    lock sync.Mutex
+    results map[int]TaskResult
+    order []int // by Ended, oldest first
+}
+
+func newMemoryResults(retention time.Duration, limit int) *memoryResults {
+    return &memoryResults{Retention: retention, Limit: limit, results: make(map[int]TaskResult)}
+}
+
+func (self *memoryResults) SaveResult(result TaskResult) error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if _, ok := self.results[result.Id]; !ok {
+        self.order = append(self.order, result.Id)
+    }
+    self.results[result.Id] = result
+    self.expire()
+    return nil
+}
+
+func (self *memoryResults) LoadResult(id int) (TaskResult, bool, error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.expire()
+    result, ok := self.results[id]
+    return result, ok, nil
+}
+
+// must hold lock
+func (self *memoryResults) expire() {
+    cutoff := time.Now().Add(-self.Retention)
+    for len(self.order) > 0 {
+        oldest := self.order[0]
+        if len(self.order) <= self.Limit && !self.results[oldest].Ended.Before(cutoff) {
+            break
+        }
+        delete(self.results, oldest)
+        self.order = self.order[1:]
+    }
+}
+
+// keep what a task came to once it's ended
+func (self *Server) saveResult(rec *taskRecord, final Task) {
+    self.taskLock.Lock()
+    result := TaskResult{
+        Id: rec.id,
+        Type: rec.status.Type,
+        Tenant: rec.status.Tenant,
+        State: rec.status.State,
+        Final: final,
+        Failure: rec.status.Failure,
+        Submitted: rec.status.Submitted,
+        Ended: time.Now(),
+        Usage: rec.status.Usage,
+    }
+    self.taskLock.Unlock()
+
+    err := self.Results.SaveResult(result)
+    if err != nil {
+        self.log().Warn("could not save task result", logTaskId, rec.id, "error", err)
+    }
+}
+
+// how an ended task turned out, for as long as the ResultStore keeps it
+func (self *Server) Result(id int) (TaskResult, bool, error) {
+    return self.Results.LoadResult(id)
+}
+
+// hand a checkpoint to a follower's channel, which holds one, without ever
+// waiting on the follower. a follower which falls behind skips to the
+// latest checkpoint, and since the channel is closed after the final one is
+// offered, that one is always delivered
+func offer[T any](follower chan T, checkpoint T) {
+    for {
+        select {
+        case follower <- checkpoint:
+            return
+        default:
+        }
+        // the follower hasn't taken the last one. it's stale now
+        select {
+        case <-follower:
+        default:
+        }
+    }
+}
@@ -0,0 +1,338 @@
+package silk
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+    "encoding/gob"
+)
+
+// what to do when a recurring task comes due while its last run is going
+type OverlapPolicy int
+
+const (
+    OverlapSkip OverlapPolicy = iota // drop this run
+    OverlapQueue // start it as soon as the last run finishes
+    OverlapReplace // cancel the last run and start this one
+)
+
+// describes when a recurring task runs. exactly one of Every or Cron is set
+type Schedule struct {
+    Name string
+    Every time.Duration
+    Cron string // e.g. "*/15 9-17 * * 1-5"
+    Overlap OverlapPolicy
+}
+
+// what gets written to Server.ScheduleFile
+type persistedSchedule struct {
+    Spec Schedule
+    Task Task
+    Next time.Time
+}
+
+// server side state of one recurring task
+type recurring struct {
+    spec Schedule
+    cron cronExpr
+    task Task
+    next time.Time
+
+    runs chan chan Task // holds the latest run, nil while nobody is listening
+    stop chan bool
+    handing sync.WaitGroup // runs which haven't handed their checkpoints to runs yet
+}
+
+func (self *recurring) after(t time.Time) time.Time {
+    if self.spec.Cron != "" {
+        return self.cron.next(t)
+    }
+    return t.Add(self.spec.Every)
+}
+
+// This is the public method to submit a recurring task
+// every time the schedule comes due the task is submitted like SubmitTask
+// the outer channel yields one checkpoint channel per run, and is closed
+// once the schedule is cancelled, taken over or never fires again
+// runs never wait for the listener: like Submission.Checkpoints, both
+// channels only hold the latest run or checkpoint, and a listener which
+// falls behind skips ahead
+// sending true on the bool channel, or closing it, cancels the schedule
+// (runs in flight are left alone). the first send never blocks
+// submitting under the name of a schedule loaded from ScheduleFile takes it
+// over, keeping its next run time
+func (self *Server) SubmitRecurring(spec Schedule, t Task) (chan chan Task, chan bool, error) {
+    r, err := newRecurring(spec, t)
+    if err != nil {
+        return nil, nil, err
+    }
+    r.runs = make(chan chan Task, 1)
+    cancel := make(chan bool, 1)
+
+    self.scheduleLock.Lock()
+    old, ok := self.schedules[spec.Name]
+    if ok {
+        if !old.next.IsZero() {
+            r.next = old.next
+        }
+        close(old.stop)
+    }
+    self.schedules[spec.Name] = r
+    self.scheduleLock.Unlock()
+
+    self.saveSchedules()
+    go self.runRecurring(r)
+    go func() {
+        select {
+        case <-cancel:
+            self.scheduleLock.Lock()
+            if self.schedules[spec.Name] == r {
+                delete(self.schedules, spec.Name)
+            }
+            self.scheduleLock.Unlock()
+            close(r.stop)
+            self.saveSchedules()
+        case <-r.stop:
+            // taken over by another SubmitRecurring
+        }
+    }()
+
+    return r.runs, cancel, nil
+}
+
+// the next time each recurring task will run, by schedule name
+func (self *Server) NextRuns() map[string]time.Time {
+    result := make(map[string]time.Time)
+
+    self.scheduleLock.Lock()
+    for name, r := range self.schedules {
+        result[name] = r.next
+    }
+    self.scheduleLock.Unlock()
+
+    return result
+}
+
+func newRecurring(spec Schedule, t Task) (*recurring, error) {
+    var err error
+    r := &recurring{spec: spec, task: t, stop: make(chan bool)}
+
+    if spec.Name == "" {
+        return nil, fmt.Errorf("recurring task must have a name")
+    }
+    if (spec.Cron == "") == (spec.Every <= 0) {
+        return nil, fmt.Errorf("recurring task %s needs exactly one of Every or Cron", spec.Name)
+    }
+    if spec.Cron != "" {
+        r.cron, err = parseCron(spec.Cron)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    r.next = r.after(time.Now())
+    if r.next.IsZero() {
+        return nil, fmt.Errorf("cron expression %q never fires", spec.Cron)
+    }
+    return r, nil
+}
+
+// one goroutine per schedule fires runs and applies the overlap policy
+func (self *Server) runRecurring(r *recurring) {
+    finished := make(chan bool)
+    running := 0
+    queued := 0
+    var replace chan bool
+
+    start := func() {
+        running++
+        replace = make(chan bool)
+        r.handing.Add(1)
+        go self.runOnce(r, replace, finished)
+    }
+
+    // nobody gets any more runs. close runs once the ones already started
+    // are done with it, so listeners ranging over it stop
+    defer func() {
+        if r.runs != nil {
+            go func() {
+                r.handing.Wait()
+                close(r.runs)
+            }()
+        }
+    }()
+
+    // r.next only moves when the timer fires, so that's the only time it's
+    // reset, with its channel already drained
+    self.scheduleLock.Lock()
+    timer := time.NewTimer(time.Until(r.next))
+    self.scheduleLock.Unlock()
+    defer timer.Stop()
+
+    for {
+        select {
+        case <-timer.C:
+            if running == 0 {
+                start()
+            } else {
+                switch r.spec.Overlap {
+                case OverlapSkip:
+                case OverlapQueue:
+                    queued++
+                case OverlapReplace:
+                    close(replace)
+                    start()
+                }
+            }
+
+            self.scheduleLock.Lock()
+            r.next = r.after(time.Now())
+            next := r.next
+            self.scheduleLock.Unlock()
+            self.saveSchedules()
+            if next.IsZero() {
+                return
+            }
+            timer.Reset(time.Until(next))
+        case <-finished:
+            running--
+            if running == 0 && queued > 0 {
+                queued--
+                start()
+            }
+        case <-r.stop:
+            return
+        }
+    }
+}
+
+// one run of a recurring task. forwards checkpoints to whoever is listening
+func (self *Server) runOnce(r *recurring, replace chan bool, finished chan bool) {
+    sub, err := self.SubmitTaskWith(r.task, TaskOptions{})
+    if err != nil {
+        sub = self.failedSubmission(r.task, err)
+    }
+
+    var out chan Task
+    self.scheduleLock.Lock()
+    runs := r.runs
+    self.scheduleLock.Unlock()
+    if runs != nil {
+        select {
+        case <-r.stop:
+        default:
+            out = make(chan Task, 1)
+            offer(runs, out)
+        }
+    }
+    r.handing.Done()
+
+outer:
+    for {
+        select {
+        case checkpoint, ok := <-sub.Checkpoints:
+            if !ok {
+                break outer
+            }
+            if out != nil {
+                offer(out, checkpoint)
+            }
+        case <-replace:
+            replace = nil
+            sub.Cancel()
+        }
+    }
+
+    if out != nil {
+        close(out)
+    }
+    select {
+    case finished <- true:
+    case <-r.stop:
+    }
+}
+
+func (self *Server) loadSchedules() {
+    if self.ScheduleFile == "" {
+        return
+    }
+
+    f, err := os.Open(self.ScheduleFile)
+    if err != nil {
+        return
+    }
+    defer f.Close()
+
+    var saved []persistedSchedule
+    err = gob.NewDecoder(f).Decode(&saved)
+    if err != nil {
+        self.log().Error("could not load recurring tasks", "file", self.ScheduleFile, "error", err)
+        return
+    }
+    self.startSchedules(saved)
+}
+
+// run saved schedules, from ScheduleFile or the server we took over from
+func (self *Server) startSchedules(saved []persistedSchedule) {
+    self.scheduleLock.Lock()
+    defer self.scheduleLock.Unlock()
+
+    for _, s := range saved {
+        r, err := newRecurring(s.Spec, s.Task)
+        if err != nil {
+            self.log().Error("dropped bad recurring task", "schedule", s.Spec.Name, "error", err)
+            continue
+        }
+        r.next = s.Next
+        self.schedules[s.Spec.Name] = r
+        go self.runRecurring(r)
+    }
+}
+
+// we're standing down. the server which took over runs the schedules now
+// ScheduleFile is left as it is, for when we take over again
+func (self *Server) stopSchedules() {
+    self.scheduleLock.Lock()
+    defer self.scheduleLock.Unlock()
+
+    for name, r := range self.schedules {
+        close(r.stop)
+        delete(self.schedules, name)
+    }
+}
+
+func (self *Server) persistedSchedules() []persistedSchedule {
+    var saved []persistedSchedule
+    self.scheduleLock.Lock()
+    for _, r := range self.schedules {
+        saved = append(saved, persistedSchedule{r.spec, r.task, r.next})
+    }
+    self.scheduleLock.Unlock()
+    return saved
+}
+
+// write the schedules to ScheduleFile, and send them to standbys
+func (self *Server) saveSchedules() {
+    saved := self.persistedSchedules()
+    self.journal.emit(journalEntry{Kind: journalSchedules, Schedules: saved})
+    if self.ScheduleFile == "" {
+        return
+    }
+
+    tmp := self.ScheduleFile + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        self.log().Warn("could not save recurring tasks", "file", self.ScheduleFile, "error", err)
+        return
+    }
+    err = gob.NewEncoder(f).Encode(&saved)
+    f.Close()
+    if err == nil {
+        err = os.Rename(tmp, self.ScheduleFile)
+    }
+    if err != nil {
+        os.Remove(tmp)
+        self.log().Warn("could not save recurring tasks", "file", self.ScheduleFile, "error", err)
+    }
+}
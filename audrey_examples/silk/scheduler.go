@@ -0,0 +1,264 @@
+package silk
+
+import (
+    "time"
+    "reflect"
+    "container/heap"
+)
+
+// reflect.Select takes at most this many cases
+const maxSelectCases = 65536
+
+// when a node times out unless it syncs first
+type nodeDeadline struct {
+    id int
+    at time.Time
+    timeout time.Duration
+    index int // in the heap
+}
+
+// the deadlines of every live node, soonest first
+type deadlineHeap []*nodeDeadline
+
+func (self deadlineHeap) Len() int {
+    return len(self)
+}
+
+func (self deadlineHeap) Less(i, j int) bool {
+    return self[i].at.Before(self[j].at)
+}
+
+func (self deadlineHeap) Swap(i, j int) {
+    self[i], self[j] = self[j], self[i]
+    self[i].index = i
+    self[j].index = j
+}
+
+func (self *deadlineHeap) Push(x interface{}) {
+    deadline := x.(*nodeDeadline)
+    deadline.index = len(*self)
+    *self = append(*self, deadline)
+}
+
+func (self *deadlineHeap) Pop() interface{} {
+    old := *self
+    deadline := old[len(old) - 1]
+    old[len(old) - 1] = nil
+    *self = old[:len(old) - 1]
+    return deadline
+}
+
+// must hold nodeLock. start the clock on a node which just joined
+func (self *Server) watchNode(id int, timeout time.Duration) {
+    if old, ok := self.nodeDeadlines[id]; ok {
+        heap.Remove(&self.deadlines, old.index)
+    }
+    deadline := &nodeDeadline{id: id, at: time.Now().Add(timeout), timeout: timeout}
+    self.nodeDeadlines[id] = deadline
+    heap.Push(&self.deadlines, deadline)
+
+    if deadline.index == 0 {
+        // sooner than whatever the scheduler is waiting for
+        self.wakeScheduler()
+    }
+}
+
+// something the scheduler waits for changed
+func (self *Server) wakeScheduler() {
+    select {
+    case self.wake <- true:
+    default:
+    }
+}
+
+// must hold nodeLock. the node synced, restart its clock
+func (self *Server) touchNode(id int) {
+    deadline, ok := self.nodeDeadlines[id]
+    if !ok {
+        return
+    }
+    deadline.at = time.Now().Add(deadline.timeout)
+    heap.Fix(&self.deadlines, deadline.index)
+}
+
+// must hold nodeLock. stop watching every node, e.g. on a simulated restart
+func (self *Server) forgetNodes() {
+    self.nodes = make(map[int]*NodeStatus)
+    self.nodeDeadlines = make(map[int]*nodeDeadline)
+    self.deadlines = nil
+}
+
+// a task from SubmitTask to start or stop watching the cancel channel of
+type cancelChange struct {
+    rec *taskRecord
+    watch bool
+}
+
+// must hold rec.lock. the scheduler picks the change up when it next wakes
+func (self *Server) watchCancel(rec *taskRecord, watch bool) {
+    self.cancelLock.Lock()
+    self.cancelChanges = append(self.cancelChanges, cancelChange{rec, watch})
+    self.cancelLock.Unlock()
+    self.wakeScheduler()
+}
+
+// what the scheduler waits on: its timer and wake, then the cancel channel
+// of every task it watches
+type cancelWatcher struct {
+    cases []reflect.SelectCase
+    recs []*taskRecord // parallel to cases, nil for the scheduler's own
+    index map[*taskRecord]int // into cases
+    waiting []*taskRecord // once cases is full, until some task ends
+}
+
+func newCancelWatcher(own ...interface{}) *cancelWatcher {
+    w := &cancelWatcher{index: make(map[*taskRecord]int)}
+    for _, c := range own {
+        w.cases = append(w.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)})
+        w.recs = append(w.recs, nil)
+    }
+    return w
+}
+
+func (self *cancelWatcher) add(rec *taskRecord) {
+    if len(self.cases) == maxSelectCases {
+        self.waiting = append(self.waiting, rec)
+        return
+    }
+    self.index[rec] = len(self.cases)
+    self.cases = append(self.cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(rec.cancel)})
+    self.recs = append(self.recs, rec)
+}
+
+func (self *cancelWatcher) remove(rec *taskRecord) {
+    i, ok := self.index[rec]
+    if !ok {
+        for j, r := range self.waiting {
+            if r == rec {
+                self.waiting = append(self.waiting[:j], self.waiting[j + 1:]...)
+                break
+            }
+        }
+        return
+    }
+
+    last := len(self.cases) - 1
+    self.cases[i], self.recs[i] = self.cases[last], self.recs[last]
+    self.index[self.recs[i]] = i
+    self.cases[last], self.recs[last] = reflect.SelectCase{}, nil
+    self.cases, self.recs = self.cases[:last], self.recs[:last]
+    delete(self.index, rec)
+
+    if len(self.waiting) > 0 {
+        next := self.waiting[0]
+        self.waiting = self.waiting[1:]
+        self.add(next)
+    }
+}
+
+// the watched tasks whose cancel channels have something to say, waiting
+// ones included
+func (self *cancelWatcher) cancelled() []*taskRecord {
+    var result []*taskRecord
+    check := func(rec *taskRecord) {
+        select {
+        case <-rec.cancel:
+            result = append(result, rec)
+        default:
+        }
+    }
+    for _, rec := range self.recs {
+        if rec != nil {
+            check(rec)
+        }
+    }
+    for _, rec := range self.waiting {
+        check(rec)
+    }
+    return result
+}
+
+// runs for the life of the server. times out nodes whose deadlines pass,
+// forgets idempotency keys whose windows have passed, and cancels tasks from
+// SubmitTask when their cancel channels say so.
+// everything else that happens to tasks and nodes happens on the goroutine
+// of whoever made it happen
+func (self *Server) schedule() {
+    timer := time.NewTimer(time.Hour)
+    watcher := newCancelWatcher(timer.C, self.wake)
+    for {
+        // a stale tick just means an early look
+        chosen, _, _ := reflect.Select(watcher.cases)
+        if rec := watcher.recs[chosen]; rec != nil {
+            watcher.remove(rec)
+            self.taskCancelled(rec)
+
+            // cancellations tend to come in bunches, and picking them one at
+            // a time costs a select over every case each
+            for _, rec := range watcher.cancelled() {
+                watcher.remove(rec)
+                self.taskCancelled(rec)
+            }
+        }
+
+        self.cancelLock.Lock()
+        changes := self.cancelChanges
+        self.cancelChanges = nil
+        self.cancelLock.Unlock()
+        for _, change := range changes {
+            if change.watch {
+                watcher.add(change.rec)
+            } else {
+                watcher.remove(change.rec)
+            }
+        }
+
+        now := time.Now()
+        self.expireNodes(now)
+        nextKey := self.sweepKeys(now)
+
+        // nothing to wait for until a node joins or a key starts expiring,
+        // which wakes us
+        next := time.Hour
+        self.nodeLock.Lock()
+        if len(self.deadlines) > 0 {
+            next = time.Until(self.deadlines[0].at)
+        }
+        self.nodeLock.Unlock()
+        if !nextKey.IsZero() && time.Until(nextKey) < next {
+            next = time.Until(nextKey)
+        }
+        timer.Reset(next)
+    }
+}
+
+// time out every node whose deadline has passed and put its task back in line
+func (self *Server) expireNodes(now time.Time) {
+    for {
+        self.nodeLock.Lock()
+        if len(self.deadlines) == 0 || self.deadlines[0].at.After(now) {
+            self.nodeLock.Unlock()
+            return
+        }
+        deadline := heap.Pop(&self.deadlines).(*nodeDeadline)
+        delete(self.nodeDeadlines, deadline.id)
+        node, ok := self.nodes[deadline.id]
+        var status NodeStatus
+        if ok {
+            status = *node
+            self.depart(node)
+            delete(self.nodes, deadline.id)
+        }
+        self.nodeLock.Unlock()
+
+        if !ok {
+            continue
+        }
+        self.log().Warn("node timed out", logNodeId, status.Id, logTaskId, status.TaskId, logRemoteAddr, status.Addr, "timeout", deadline.timeout)
+        self.nodeTimedOut(status.Id, machine(status.Caps), status.TaskId)
+        self.nodeLost(status.Id, status.TaskId)
+
+        self.events.emit(EventNodeTimeout, status.Id, status.TaskId, "")
+        self.journal.emit(journalEntry{Kind: journalNodeGone, NodeId: status.Id})
+    }
+}
@@ -2,6 +2,9 @@ package silk
 
 import (
     "os"
+    "fmt"
+    "sync"
+    "errors"
     "time"
     "bytes"
     "net/http"
@@ -23,29 +26,98 @@ func (self *Server) Serve() (chan ClientCaps, chan Task) {
     self.nextTaskId = 1
     self.nextNodeId = 1
 
-    self.taskQueue = make(chan taskWithId)
     self.rememberedTasks = make(chan Task)
     self.nodeEvents = make(chan ClientCaps)
-    self.taskProgressMap = make(map[int]chan Task)
-    self.nodeHeartbeatMap = make(map[int]chan int)
+    self.tasks = make(map[int]*taskRecord)
+    self.nodes = make(map[int]*NodeStatus)
+    self.nodeDeadlines = make(map[int]*nodeDeadline)
+    self.wake = make(chan bool, 1)
+    self.reannounce = make(chan bool, 1)
+    self.identities = make(map[string]int)
+    self.departed = make(map[int]NodeStatus)
+    self.events = newEventLog()
+    self.schedules = make(map[string]*recurring)
+    self.keys = make(map[string]*keyedTask)
+    self.journal = newJournal()
+    self.health = make(map[string]*NodeHealth)
+    self.tenantResources = make(map[string]*ResourceUsage)
+    self.nodeResources = make(map[int]*ResourceUsage)
+    self.active = self.Standby == ""
 
     if self.NodeTimeout == 0 {
         self.NodeTimeout = time.Duration(60 * time.Second)
     }
+    self.makePools()
+
+    if self.IdempotencyWindow == 0 {
+        self.IdempotencyWindow = time.Duration(time.Hour)
+    }
+
+    if self.QuarantineScore == 0 {
+        self.QuarantineScore = 3
+    }
+
+    if self.QuarantineCooldown == 0 {
+        self.QuarantineCooldown = time.Duration(10 * time.Minute)
+    }
+
+    if self.Results == nil {
+        if self.ResultRetention == 0 {
+            self.ResultRetention = time.Duration(24 * time.Hour)
+        }
+        if self.MaxResults == 0 {
+            self.MaxResults = 10000
+        }
+        self.Results = newMemoryResults(self.ResultRetention, self.MaxResults)
+    }
+
+    if self.FailoverTimeout == 0 {
+        self.FailoverTimeout = time.Duration(5 * time.Second)
+    }
 
     if self.ServerId == 0 {
         self.ServerId = int(time.Now().UnixNano())
     }
 
+    if self.active {
+        self.term = 1
+    }
+    self.relog()
+
+    if self.RecordFile != "" {
+        recorder, err := newRecorder(self.RecordFile)
+        if err != nil {
+            self.log().Error("could not open record file, not recording", "path", self.RecordFile, "error", err)
+        } else {
+            self.recorder = recorder
+        }
+    }
+
     mux := http.NewServeMux()
     mux.Handle("/sync", self)
     mux.Handle("/download", http.FileServer(downloadClient{}))
+    mux.Handle("/api/", apiHandler{self})
+    mux.Handle("/dashboard", dashboardHandler{self})
+    mux.Handle("/dashboard/", dashboardHandler{self})
+    mux.Handle("/replicate", http.HandlerFunc(self.serveJournal))
 
     srv := &http.Server{
         Addr: self.Listen,
         Handler: mux,
     }
     go func() {panic(srv.ListenAndServe())}()
+    self.log().Info("serving", "listen", self.Listen, "version", self.Version, "standby_of", self.Standby)
+
+    if self.active {
+        self.loadSchedules()
+    } else {
+        go self.replicate()
+    }
+    go self.schedule()
+    go self.sampleQueueDepth()
+    if self.Announce != "" {
+        go self.announce()
+    }
 
     return self.nodeEvents, self.rememberedTasks
 }
@@ -62,39 +134,85 @@ func (self *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     var syncReq SyncRequest
     var syncResp SyncResponse
 
-    var heartbeat chan int
     var nodeId int
     var ok bool
     var err error
 
-    var taskOnWire, remembering, sendNewTask bool
+    var taskOnWire, remembering, returning, sendNewTask bool
+
+    log := self.log().With(logRemoteAddr, r.RemoteAddr)
+
+    // record the exchange however it turns out
+    var decoded, responded bool
+    var reported, sent *taskWithId
+    recording, w := self.recorder.startSync(w, r)
+    defer func() {
+        var req *SyncRequest
+        var resp *SyncResponse
+        if decoded {
+            req = &syncReq
+        }
+        if responded {
+            resp = &syncResp
+        }
+        recording.finish(req, reported, resp, sent)
+    }()
 
     // Step 1: Validate method
     if r.Method != "POST" {
+        log.Warn("rejected sync with bad method", "method", r.Method)
         http.Error(w, "Bad method - must only POST to /sync", 400)
         return
     }
 
+    // standbys send nodes on to the active server
+    if !self.isActive() {
+        log.Debug("turned node away while standing by")
+        http.Error(w, "Standby", 503)
+        return
+    }
+    self.chaosIn()
+
     // Step 2: Receive SyncRequest
     d := gob.NewDecoder(r.Body)
     err = d.Decode(&syncReq)
     if err != nil {
+        log.Warn("could not decode SyncRequest", "error", err)
         http.Error(w, "Could not decode SyncRequest", 400)
         return
     }
+    decoded = true
+
+    // Step 2.1: a node which has synced with a server which took over from
+    // us. it'll run whatever that server gives it, so we mustn't
+    serverId, term := self.currentTerm()
+    if syncReq.ServerId == serverId && syncReq.Term > term {
+        self.standDown(syncReq.Term)
+        http.Error(w, "Standby", 503)
+        return
+    }
 
-    // Step 3: Enforce api versioning
-    if syncReq.Version != self.Version {
+    // Step 3: Enforce api versioning, which is per pool
+    pool, err := self.pool(syncReq.Caps.Pool)
+    if err != nil {
+        log.Warn("rejected node in unknown pool", "pool", syncReq.Caps.Pool)
+        http.Error(w, "No such pool", 400)
+        return
+    }
+    if syncReq.Version != pool.config.Version {
+        log.Info("told node to upgrade", logNodeId, syncReq.Caps.NodeId, "node_version", syncReq.Version, "pool", pool.name)
         buf := bytes.Buffer{}
         e := gob.NewEncoder(&buf)
-        syncResp = SyncResponse{self.Version, -1, -1, "Must upgrade"}
+        syncResp = SyncResponse{pool.config.Version, -1, -1, "Must upgrade", TraceContext{}, term}
+        responded = true
         err = e.Encode(&syncResp)
         if err != nil {
+            log.Error("could not encode SyncResponse for upgrade", "error", err)
             http.Error(w, "Could not encode SyncResponse for upgrade..?", 500)
         } else {
             _, err = buf.WriteTo(w)
             if err != nil {
-                // TODO: log nasty message
+                log.Warn("could not write upgrade response", "error", err)
             }
         }
         return
@@ -106,27 +224,41 @@ func (self *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     sendNewTask = true // are we going to pop a new task from the queue?
 
     if syncReq.Caps.NodeId == -1 {
-        // new node joining the pool
-        nodeId, heartbeat = self.createNode(syncReq.Caps)
+        // new node joining the pool, or one we know by its identity
+        nodeId, returning = self.createNode(syncReq.Caps, r.RemoteAddr)
+        log = log.With(logNodeId, nodeId)
+        if returning {
+            log.Info("node rejoined", "identity", syncReq.Caps.Identity)
+        } else {
+            log.Info("node joined", "pool", pool.name)
+        }
     } else {
         // not their first rodeo. there should be a task on the wire.
         taskOnWire = true
-        if syncReq.ServerId != self.ServerId {
+        if syncReq.ServerId != serverId {
             // node rejoining rebooted server
-            nodeId, heartbeat = self.createNode(syncReq.Caps)
+            nodeId, _ = self.createNode(syncReq.Caps, r.RemoteAddr)
             remembering = true
+            log = log.With(logNodeId, nodeId)
+            log.Info("node rejoined after server restart", "old_node_id", syncReq.Caps.NodeId, "old_server_id", syncReq.ServerId)
         } else {
             // supposedly a node reporting back. validate this:
             nodeId = syncReq.Caps.NodeId
             self.nodeLock.Lock()
-            heartbeat, ok = self.nodeHeartbeatMap[nodeId]
+            _, ok = self.nodeDeadlines[nodeId]
             self.nodeLock.Unlock()
 
             if !ok {
-                // TODO print a nasty warning
                 // probably a node somehow took longer than timeout to report back?
-                nodeId, heartbeat = self.createNode(syncReq.Caps)
+                nodeId, returning = self.createNode(syncReq.Caps, r.RemoteAddr)
+                log = log.With(logNodeId, nodeId)
+                if returning {
+                    log.Warn("timed out node came back", "identity", syncReq.Caps.Identity)
+                } else {
+                    log.Warn("unknown node reported in, probably timed out. treating it as new", "old_node_id", syncReq.Caps.NodeId)
+                }
             } else {
+                log = log.With(logNodeId, nodeId)
                 sendNewTask = false
             }
         }
@@ -137,175 +269,618 @@ func (self *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
         // Step 5.1: Decode task
         err = d.Decode(&oldTask)
         if err != nil {
+            log.Warn("could not decode task", "error", err)
             http.Error(w, "Could not decode Task", 400)
             return
         }
+        wire := oldTask
+        reported = &wire
+        taskLog := log.With(logTaskId, oldTask.TaskId)
+
+        // Step 5.2: Reclaim task from before a timeout
+        if returning && oldTask.TaskId != -1 {
+            if self.reclaimTask(oldTask.TaskId, nodeId) {
+                taskLog.Info("node took its task back")
+                sendNewTask = false
+            } else {
+                // it went to another node, or ended, while this one was
+                // gone. drop the report and treat the node as idle
+                taskLog.Info("dropped report for task given away while node was gone")
+                self.Chaos.staleReport()
+                oldTask = taskWithId{-1, nil}
+            }
+        }
 
-        // Step 5.2: Process task
-        if remembering {
-            self.rememberedTasks <- oldTask.Task
+        // Step 5.3: Process task
+        if oldTask.TaskId == -1 {
+            // idle node
+            log.Debug("idle node checked in")
+            sendNewTask = true
+        } else if remembering {
+            if self.Chaos.pastServer(syncReq.ServerId) {
+                // we still have the task, requeued when we "restarted"
+                taskLog.Info("dropped report from before simulated restart")
+            } else if oldTask.Task != nil {
+                taskLog.Info("remembered task from before restart")
+                self.rememberedTasks <- oldTask.Task
+            }
         } else {
             self.taskLock.Lock()
-            progress, ok := self.taskProgressMap[oldTask.TaskId]
+            rec, ok := self.tasks[oldTask.TaskId]
+            ok = ok && !rec.over()
+            assigned := ok && rec.status.State == TaskRunning && rec.status.NodeId == nodeId
             self.taskLock.Unlock()
 
             if !ok {
-                // task was cancelled
+                // task was cancelled or has ended. a heartbeat hears about
+                // it here too, so the node drops it without waiting for a
+                // checkpoint
+                taskLog.Info("dropped report for cancelled task", "failure", syncReq.Failure)
+                sendNewTask = true
+            } else if !assigned {
+                // the task was taken from the node while it was out of
+                // touch, and may be running elsewhere by now
+                taskLog.Info("dropped stale report", "failure", syncReq.Failure)
+                self.Chaos.staleReport()
+                sendNewTask = true
+            } else if oldTask.Task == nil && syncReq.Failure == "" {
+                // plain heartbeat, nothing to report
+                taskLog.Debug("heartbeat")
+            } else if syncReq.Failure != "" {
+                // the task crashed on the node. the node itself is fine
+                taskLog.Warn("task failed on node", "reason", syncReq.Failure)
+                self.taskReported(oldTask.TaskId, &syncReq)
+                if machine, ok := self.nodeMachine(nodeId); ok {
+                    self.nodeTaskFailed(nodeId, machine, rec)
+                }
+                self.taskProgressed(rec, nodeId, TaskFailed{syncReq.Failure, oldTask.Task})
                 sendNewTask = true
             } else {
                 // if we got this far there was a successful checkpoint
-                // let the task watchdog know
-                progress <- oldTask.Task
+                interval := self.taskReported(oldTask.TaskId, &syncReq)
+                if machine, ok := self.nodeMachine(nodeId); ok {
+                    self.nodeCheckpointed(nodeId, machine, interval)
+                    self.taskRanOn(rec, machine)
+                }
+                self.taskProgressed(rec, nodeId, oldTask.Task)
+                if oldTask.Task.IsDone() {
+                    taskLog.Info("task finished")
+                    sendNewTask = true
+                } else {
+                    taskLog.Debug("checkpoint")
+                }
             }
         }
     }
 
     // Step 6: Pick task to send
-    syncResp = SyncResponse{self.Version, self.ServerId, nodeId, "um."}
-    if sendNewTask {
-        select {
-        case newTask = <-self.taskQueue:
+    syncResp = SyncResponse{pool.config.Version, serverId, nodeId, "um.", TraceContext{}, term}
+    responded = true
+    self.nodeLock.Lock()
+    node, ok := self.nodes[nodeId]
+    draining := ok && node.Draining
+    var labels map[string]string
+    var nodeMachine string
+    assignedTask := -1
+    if ok {
+        labels = node.Caps.Labels
+        nodeMachine = machine(node.Caps)
+        assignedTask = node.TaskId
+    }
+    self.nodeLock.Unlock()
+    quarantined := ok && self.machineQuarantined(nodeMachine)
+
+    // a node which doesn't know about the task we last gave it never got
+    // our reply. give it the task again rather than leave it stranded
+    var resend taskWithId
+    var resendTrace TraceContext
+    resending := false
+    if assignedTask != -1 && assignedTask != oldTask.TaskId {
+        resend, resendTrace, resending = self.undeliveredTask(assignedTask, nodeId)
+    }
+
+    if resending {
+        newTask = resend
+        syncResp.Message = "New task!"
+        syncResp.Trace = resendTrace
+        log.Info("resent task the node never got", logTaskId, newTask.TaskId)
+    } else if sendNewTask && draining {
+        newTask = taskWithId{-1, nil}
+        syncResp.Message = "Draining"
+        log.Debug("not dispatching to draining node")
+    } else if sendNewTask && quarantined {
+        newTask = taskWithId{-1, nil}
+        syncResp.Message = "Quarantined"
+        log.Debug("not dispatching to quarantined node")
+    } else if sendNewTask {
+        newTask, ok = pool.queue.pop(labels)
+        if ok {
             syncResp.Message = "New task!"
-        default:
+            syncResp.Trace = self.taskDispatched(newTask.TaskId, nodeId)
+            log.Debug("dispatched task", logTaskId, newTask.TaskId)
+        } else {
             // no work to do...
-            newTask = taskWithId{-1, nil}
             syncResp.Message = "No work to do..."
+            log.Debug("no work to dispatch")
         }
     } else {
         newTask = taskWithId{oldTask.TaskId, nil}
         syncResp.Message = "Work on old task"
     }
 
-    // Step 7: Update node watchdog with task allocation
-    heartbeat <- newTask.TaskId
+    // Step 7: Note the node's task allocation and restart its clock
+    self.nodeLock.Lock()
+    node, ok = self.nodes[nodeId]
+    if ok {
+        node.LastSeen = time.Now()
+        node.TaskId = newTask.TaskId
+    }
+    self.touchNode(nodeId)
+    self.nodeLock.Unlock()
 
     // Step 8: Send response!
     buf := bytes.Buffer{}
     e := gob.NewEncoder(&buf)
     err = e.Encode(&syncResp)
     if err != nil {
+        log.Error("could not encode SyncResponse", "error", err)
         http.Error(w, "Could not encode SyncResponse for task..?", 500)
         return
     }
 
     err = e.Encode(&newTask)
     if err != nil {
+        log.Error("could not encode task", logTaskId, newTask.TaskId, "error", err)
         http.Error(w, "Could not encode task", 500)
         return
     }
 
-    _, err = buf.WriteTo(w)
+    sent = &newTask
+    reply, ok := self.chaosOut(w, buf.Bytes())
+    if !ok {
+        log.Warn("chaos: dropped reply", logTaskId, newTask.TaskId)
+        return
+    }
+    _, err = w.Write(reply)
     if err != nil {
-        // TODO: log nasty error
+        log.Warn("could not write sync response", logTaskId, newTask.TaskId, "error", err)
     }
 }
 
-// one goroutine per node handles the node's membership in the server struct
-// timeout watchdog will clean up after the node if it disappears and
-// reschedule any dropped jobs
-func (self *Server) createNode(caps ClientCaps) (int, chan int) {
+// track a node which is joining. the scheduler times it out if it stops
+// syncing, and puts its task back in line. nodes with an Identity we've seen
+// before get their old id back, and the bool is true
+func (self *Server) createNode(caps ClientCaps, addr string) (int, bool) {
+    id, known, live := self.knownNode(caps.Identity)
+    if live {
+        self.rejoinNode(id, caps, addr)
+        return id, true
+    }
+
+    if !known {
+        self.nodeLock.Lock()
+        id = self.nextNodeId
+        self.nextNodeId++
+        self.nodeLock.Unlock()
+    }
+
     self.nodeEvents <- caps
+    self.addNode(id, caps, addr, -1)
+    return id, known
+}
 
-    heartbeat := make(chan int)
+// start tracking a node under the given id, running curTask
+func (self *Server) addNode(id int, caps ClientCaps, addr string, curTask int) {
+    timeout := self.NodeTimeout
+    if pool, err := self.pool(caps.Pool); err == nil {
+        timeout = pool.config.NodeTimeout
+    }
+    now := time.Now()
 
     self.nodeLock.Lock()
-    id := self.nextNodeId
-    self.nextNodeId++
-    self.nodeHeartbeatMap[id] = heartbeat
-    self.nodeLock.Unlock()
-
-    go func() {
-        curTask := -1
-outer:
-        for {
-            select {
-            case curTask = <-heartbeat:
-                // keep track of the current task the node is working on
-            case <-time.After(self.NodeTimeout):
-                // timeout!
-                if curTask != -1 {
-                    self.taskLock.Lock()
-                    progress, ok := self.taskProgressMap[curTask]
-                    self.taskLock.Unlock()
-
-                    if ok {
-                        // signal to the checkpointer to reschedule the job
-                        progress <- nil
-                    }   // otherwise the job has been cancelled so no harm done
-                }
-                break outer
-            }
+    node := &NodeStatus{id, caps, addr, now, now, 0, curTask, false, false}
+    old, returning := self.departed[id]
+    if returning {
+        // pick up where it left off
+        delete(self.departed, id)
+        if len(caps.Labels) == 0 {
+            caps.Labels = old.Caps.Labels
         }
+        node.Joined = old.Joined
+        node.Rejoins = old.Rejoins + 1
+        node.Draining = old.Draining
+    }
+    caps.Labels = nodeLabels(caps, addr)
+    node.Caps = caps
+    if caps.Identity != "" {
+        self.identities[caps.Identity] = id
+    }
+    self.nodes[id] = node
+    self.watchNode(id, timeout)
+    self.nodeLock.Unlock()
 
-        self.nodeLock.Lock()
-        delete(self.nodeHeartbeatMap, id)
-        self.nodeLock.Unlock()
-    }()
-
-    return id, heartbeat
+    if returning {
+        self.events.emit(EventNodeRejoined, id, curTask, addr)
+    } else {
+        self.events.emit(EventNodeJoined, id, curTask, addr)
+    }
+    self.journal.emit(journalEntry{Kind: journalNode, NodeId: id, Caps: caps, Addr: addr})
 }
 
 // This is the public method to submit a task
-// one goroutine per task handles the task's membership in the server struct
-// and forward checkpoints to the output channel
+// it is SubmitTaskWith without any of the options
 // if block is true it'll block until some node has taken the task
 // otherwise we'll return immediately
 // the task channel will yield progressive results
-// the bool channel can be used to cancel the task
+// sending true on or closing the bool channel cancels the task. the
+// scheduler watches it along with every other task's until the task ends
+// if the task can't be admitted the task channel yields only TaskFailed
 func (self *Server) SubmitTask(t Task, block bool) (chan Task, chan bool) {
-    checkpoints := make(chan Task)
-    cancel := make(chan bool)
+    cancel := make(chan bool, 1)
+    sub, err := self.SubmitTaskWith(t, TaskOptions{Block: block})
+    if err != nil {
+        return self.failedSubmission(t, err).Checkpoints, cancel
+    }
+
+    sub.rec.lock.Lock()
+    if !sub.rec.ended {
+        sub.rec.cancel = cancel
+        self.watchCancel(sub.rec, true)
+    }
+    sub.rec.lock.Unlock()
+    return sub.Checkpoints, cancel
+}
+
+// stands in for a task which couldn't be admitted. the stream yields only
+// TaskFailed and Cancel does nothing
+func (self *Server) failedSubmission(t Task, err error) *Submission {
+    checkpoints := make(chan Task, 1)
+    checkpoints <- TaskFailed{err.Error(), t}
+    close(checkpoints)
+    return &Submission{-1, checkpoints, TraceContext{}, self, &taskRecord{id: -1, ended: true}}
+}
+
+// server side record of a submitted task
+type taskRecord struct {
+    id int
+    status TaskStatus // guarded by taskLock
+    latest Task // guarded by taskLock
+    submitted Task // as it was submitted, for replication
+    priority int
+    placement Placement
+    pool *pool
+    key string // idempotency key, "" if none
+
+    // whatever happens to the task happens under lock, one thing at a time,
+    // on the goroutine of whoever made it happen
+    lock sync.Mutex
+    item *queueItem
+    followers []chan Task // each holds at most the latest checkpoint
+    ended bool
+    final Task // latest checkpoint when the task ended, nil if there was none
+    cancel chan bool // from SubmitTask, watched by the scheduler until the task ends
+
+    // open spans, guarded by taskLock
+    span *Span
+    queuedSpan *Span
+    attemptSpan *Span
+    lastReport time.Time // where the next checkpoint span starts
+    progressHistory []progressSample // of the current attempt, guarded by taskLock
+    ranOn map[string]bool // machines which checkpointed it, guarded by taskLock
+}
+
+// Submit a task with options
+// the task gets no goroutine of its own. nodes' reports, cancellations and
+// followers all act on its record directly
+// returns ErrOverloaded if the queue is full and the admission policy says
+// so, or if opts.Block is waiting when the task is shed to make room
+func (self *Server) SubmitTaskWith(t Task, opts TaskOptions) (*Submission, error) {
+    if !self.serving {
+        return nil, errors.New("Called SubmitTask() before Serve()")
+    }
+    if !self.isActive() {
+        return nil, ErrStandby
+    }
+    pool, err := self.pool(opts.Pool)
+    if err != nil {
+        return nil, err
+    }
+
+    rec := &taskRecord{
+        submitted: t,
+        priority: opts.Priority,
+        placement: opts.Placement,
+        pool: pool,
+        key: opts.IdempotencyKey,
+    }
 
-    taskProgress := make(chan Task)
+    // nobody can act on the task, or attach to it through its key, until
+    // it has an id
+    rec.lock.Lock()
+
+    // before the task gets an id or any spans, so a duplicate uses up neither
+    if opts.IdempotencyKey != "" {
+        existing := self.claimKey(opts.IdempotencyKey, rec)
+        if existing != nil {
+            rec.lock.Unlock()
+            return existing.attach(self), nil
+        }
+    }
 
     self.taskLock.Lock()
-    id := self.nextTaskId
+    rec.id = self.nextTaskId
     self.nextTaskId++
-    self.taskProgressMap[id] = taskProgress
     self.taskLock.Unlock()
 
-    if block {
-        self.taskQueue <- taskWithId{id, t}
+    rec.span = startSpan(opts.Trace, "task", "task_id", fmt.Sprint(rec.id), "type", fmt.Sprintf("%T", t), "tenant", opts.Tenant)
+    rec.queuedSpan = startSpan(rec.span.context(), "queued")
+
+    rec.status = TaskStatus{
+        Id: rec.id,
+        Type: fmt.Sprintf("%T", t),
+        Tenant: opts.Tenant,
+        Pool: opts.Pool,
+        State: TaskQueued,
+        NodeId: -1,
+        Submitted: time.Now(),
     }
 
-    go func() {
-        if !block {
-            select {
-            case self.taskQueue <- taskWithId{id, t}:
-            case <-cancel:
-                return
-            }
-        }
+    self.taskLock.Lock()
+    self.tasks[rec.id] = rec
+    self.taskLock.Unlock()
 
-outer:
-        for {
-            checkpoint := t
+    // with AdmitBlock, push can wait a long time for room. meanwhile the
+    // task can be attached to through its key, or cancelled
+    rec.lock.Unlock()
+    item, evicted, err := pool.queue.push(taskWithId{rec.id, t}, opts.Tenant, opts.Priority, opts.Placement)
+    if evicted != nil {
+        self.taskShed(evicted.task.TaskId)
+    }
 
-            select {
-            case progress := <-taskProgress:
-                if progress == nil {
-                    // node died. resubmit from checkpoint
-                    self.taskQueue <- taskWithId{id, checkpoint}
-                    continue outer
-                }
-                checkpoints <- progress
-                checkpoint = progress
+    var spans spanBatch
+    rec.lock.Lock()
+    cancelled := rec.ended
+    if err != nil {
+        if !cancelled {
+            self.taskLock.Lock()
+            delete(self.tasks, rec.id)
+            spans.finish(rec.queuedSpan)
+            rec.span.set("error", err.Error())
+            spans.finish(rec.span)
+            self.taskLock.Unlock()
 
-                if progress.IsDone() {
-                    break outer
-                }
-            case <-cancel:
-                // server should check to see if we've deleted the entry from
-                // the map to detect cancellation
-                break outer
+            // anyone who attached in the meantime sees an empty stream
+            rec.ended = true
+            rec.closeFollowers()
+        }
+        rec.lock.Unlock()
+        spans.export(self.SpanExporter)
+        if opts.IdempotencyKey != "" && !cancelled {
+            self.dropKey(opts.IdempotencyKey, rec)
+        }
+        return nil, err
+    }
+    rec.item = item
+    if cancelled {
+        // it was cancelled while waiting for room. a node may have taken
+        // it already, and is told to drop it like any cancelled task
+        pool.queue.finish(item)
+        rec.lock.Unlock()
+        return rec.attach(self), nil
+    }
+    checkpoints := make(chan Task, 1)
+    rec.followers = append(rec.followers, checkpoints)
+    if opts.IdempotencyKey != "" {
+        self.keyQueued(opts.IdempotencyKey, rec)
+    }
+    rec.lock.Unlock()
+
+    self.recorder.submitted(rec.id, t, opts)
+    self.events.emit(EventTaskSubmitted, -1, rec.id, rec.status.Type)
+    self.journal.emit(journalEntry{Kind: journalTask, TaskId: rec.id, Task: t, Tenant: opts.Tenant, Pool: opts.Pool, Priority: opts.Priority, Placement: opts.Placement})
+
+    if opts.Block {
+        select {
+        case <-item.taken:
+        case <-item.ended:
+            if item.evicted {
+                // never taken, and never will be
+                return nil, ErrOverloaded
             }
         }
+    }
 
-        close(checkpoints)
-        self.taskLock.Lock()
-        delete(self.taskProgressMap, id)
-        self.taskLock.Unlock()
+    return &Submission{rec.id, checkpoints, rec.span.context(), self, rec}, nil
+}
+
+// must hold taskLock
+func (self *taskRecord) over() bool {
+    switch self.status.State {
+    case TaskDone, TaskFailedState, TaskCancelled:
+        return true
+    }
+    return false
+}
+
+// must hold lock
+func (self *taskRecord) offer(checkpoint Task) {
+    for _, follower := range self.followers {
+        offer(follower, checkpoint)
+    }
+}
+
+// must hold lock
+func (self *taskRecord) closeFollowers() {
+    for _, follower := range self.followers {
+        close(follower)
+    }
+    self.followers = nil
+}
+
+// must hold rec.lock. what to resume the task from if it has to start over
+func (self *Server) lastCheckpoint(rec *taskRecord) Task {
+    self.taskLock.Lock()
+    checkpoint := rec.latest
+    self.taskLock.Unlock()
+
+    if checkpoint == nil {
+        return rec.submitted
+    }
+    return checkpoint
+}
+
+// nodeId sent a checkpoint of rec, or reported it failed
+func (self *Server) taskProgressed(rec *taskRecord, nodeId int, report Task) {
+    var spans spanBatch
+    defer func() {
+        spans.export(self.SpanExporter)
     }()
 
-    return checkpoints, cancel
+    rec.lock.Lock()
+    defer rec.lock.Unlock()
+
+    self.taskLock.Lock()
+    assigned := rec.status.State == TaskRunning && rec.status.NodeId == nodeId
+    self.taskLock.Unlock()
+    if rec.ended || !assigned {
+        // it went elsewhere while the report was on its way
+        return
+    }
+
+    self.taskCheckpointed(rec, report)
+    rec.offer(report)
+    if report.IsDone() {
+        rec.pool.queue.finish(rec.item)
+        self.endTask(rec, report, &spans)
+    }
+}
+
+// nodeId went away while running rec. resubmit it from checkpoint
+func (self *Server) taskLost(rec *taskRecord, nodeId int) {
+    var spans spanBatch
+    defer func() {
+        spans.export(self.SpanExporter)
+    }()
+
+    rec.lock.Lock()
+    defer rec.lock.Unlock()
+
+    self.taskLock.Lock()
+    assigned := rec.status.State == TaskRunning && rec.status.NodeId == nodeId
+    self.taskLock.Unlock()
+    if rec.ended || !assigned {
+        return
+    }
+
+    self.log().Warn("requeueing task from last checkpoint", logTaskId, rec.id)
+    self.taskRequeued(rec, &spans)
+    rec.pool.queue.requeue(rec.item, self.lastCheckpoint(rec))
+}
+
+// the node running rec, if any, finds out when it next reports and is
+// told to drop it
+func (self *Server) taskCancelled(rec *taskRecord) {
+    var spans spanBatch
+    defer func() {
+        spans.export(self.SpanExporter)
+    }()
+
+    rec.lock.Lock()
+    defer rec.lock.Unlock()
+
+    if rec.ended {
+        return
+    }
+    self.log().Info("task cancelled", logTaskId, rec.id)
+    self.recorder.cancelled(rec.id)
+    // with no item it's still waiting for room in the queue, and
+    // SubmitTaskWith takes it back out
+    if rec.item != nil {
+        rec.pool.queue.finish(rec.item)
+    }
+
+    self.taskLock.Lock()
+    final := rec.latest
+    self.taskLock.Unlock()
+    self.endTask(rec, final, &spans)
+}
+
+// task id was evicted from its queue to make room for a higher priority one
+func (self *Server) taskShed(id int) {
+    self.taskLock.Lock()
+    rec, ok := self.tasks[id]
+    self.taskLock.Unlock()
+    if !ok {
+        return
+    }
+
+    var spans spanBatch
+    defer func() {
+        spans.export(self.SpanExporter)
+    }()
+
+    rec.lock.Lock()
+    defer rec.lock.Unlock()
+
+    if rec.ended {
+        return
+    }
+    failure := TaskFailed{"evicted from the queue by a higher priority task", self.lastCheckpoint(rec)}
+    self.log().Warn("task evicted from full queue", logTaskId, rec.id, "tenant", rec.status.Tenant)
+    rec.offer(failure)
+    self.endTask(rec, failure, &spans)
+}
+
+// must hold rec.lock. the task is over, final is how it ended. its spans
+// go in spans, for the caller to export once it lets go of rec.lock
+func (self *Server) endTask(rec *taskRecord, final Task, spans *spanBatch) {
+    rec.ended = true
+    self.taskEnded(rec, final, spans)
+    self.saveResult(rec, final)
+    rec.final = final
+    rec.closeFollowers()
+
+    if rec.cancel != nil {
+        self.watchCancel(rec, false)
+    }
+    if rec.key != "" {
+        self.releaseKey(rec.key, rec, final)
+    }
+}
+
+// cancel the task. does nothing once it has ended
+func (self *Submission) Cancel() {
+    self.server.taskCancelled(self.rec)
+}
+
+// follow an already submitted task. if it has ended already the stream
+// yields only its final checkpoint
+func (self *taskRecord) attach(server *Server) *Submission {
+    checkpoints := make(chan Task, 1)
+
+    self.lock.Lock()
+    if self.ended {
+        if self.final != nil {
+            checkpoints <- self.final
+        }
+        close(checkpoints)
+    } else {
+        // catch the newcomer up with the latest checkpoint
+        server.taskLock.Lock()
+        latest := self.latest
+        server.taskLock.Unlock()
+        if latest != nil {
+            checkpoints <- latest
+        }
+        self.followers = append(self.followers, checkpoints)
+    }
+    self.lock.Unlock()
+
+    return &Submission{self.id, checkpoints, self.span.context(), server, self}
+}
+
+// what each tenant has submitted to DefaultPool and is running there, by
+// tenant name. see PoolTenantUsage for the other pools
+func (self *Server) TenantUsage() map[string]TenantUsage {
+    return self.pools[DefaultPool].queue.usage()
 }
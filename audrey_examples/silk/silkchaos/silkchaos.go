@@ -0,0 +1,239 @@
+// silkchaos runs a silk server and some clients in one process with faults
+// injected on both sides, and checks that every task either finished exactly
+// once or was reported failed
+//
+//   silkchaos [-seed N] [-tasks N] [-nodes N] [-drop P] [-delay P]
+//       [-corrupt P] [-stall P] [-kill P] [-restart P] ...
+//
+// runs with the same seed make the same fault decisions, in the same order.
+// exits 1 if any task was lost or finished twice
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "sort"
+    "time"
+    "strings"
+    "log/slog"
+    "sync/atomic"
+
+    "github.com/rhelmot/golang-concurrency-supercool/audrey_examples/silk"
+)
+
+var seed = flag.Int64("seed", 1, "seed for the fault injection")
+var tasks = flag.Int("tasks", 50, "tasks to submit")
+var steps = flag.Int("steps", 20, "checkpoints per task")
+var nodes = flag.Int("nodes", 4, "clients to run")
+var listen = flag.String("listen", "127.0.0.1:18390", "address for the server")
+var nodeTimeout = flag.Duration("node-timeout", 2 * time.Second, "server NodeTimeout")
+var deadline = flag.Duration("timeout", 5 * time.Minute, "give up on tasks which haven't ended by then")
+var drop = flag.Float64("drop", 0.05, "chance of losing a sync request or reply")
+var delay = flag.Float64("delay", 0.05, "chance of delaying a sync")
+var corrupt = flag.Float64("corrupt", 0.02, "chance of cutting a sync short")
+var stall = flag.Float64("stall", 0.005, "chance of a client going quiet past node-timeout")
+var kill = flag.Float64("kill", 0.005, "chance of a task crashing at a checkpoint")
+var restart = flag.Float64("restart", 0.002, "chance of the server restarting at a sync")
+var verbose = flag.Bool("v", false, "log what the server and clients get up to")
+
+// counts to Target, checkpointing every step
+type Step struct {
+    N int
+    Target int
+}
+
+func (self Step) IsDone() bool {
+    return self.N >= self.Target
+}
+
+func (self Step) Run(progress chan silk.Task, cancel chan bool) {
+    for !self.IsDone() {
+        select {
+        case <-cancel:
+            return
+        case <-time.After(10 * time.Millisecond):
+        }
+        self.N++
+        progress <- self
+    }
+    <-cancel
+}
+
+// how one submission turned out, as seen by its submitter
+type outcome struct {
+    task int
+    done int // done checkpoints seen
+    failed int // failures seen
+    reason string
+    closed bool // the stream ended
+}
+
+func main() {
+    flag.Parse()
+    silk.RegisterTaskType(Step{})
+
+    level := slog.LevelError
+    if *verbose {
+        level = slog.LevelInfo
+    }
+    logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+    serverChaos := &silk.Chaos{
+        Seed: *seed,
+        DropSync: *drop,
+        DelaySync: *delay,
+        MaxDelay: 200 * time.Millisecond,
+        CorruptSync: *corrupt,
+        RestartServer: *restart,
+    }
+    server := &silk.Server{
+        Version: 1,
+        Listen: *listen,
+        NodeTimeout: *nodeTimeout,
+        Logger: logger,
+        Chaos: serverChaos,
+        QuarantineScore: 1e9, // chaos isn't the nodes' fault
+    }
+    joined, remembered := server.Serve()
+    go func() {
+        for range joined {
+        }
+    }()
+    var rememberedCount atomic.Int64
+    go func() {
+        for range remembered {
+            rememberedCount.Add(1)
+        }
+    }()
+
+    host, port := splitListen(*listen)
+    var clientChaos []*silk.Chaos
+    for i := 0; i < *nodes; i++ {
+        chaos := &silk.Chaos{
+            Seed: *seed + int64(i) + 1,
+            DropSync: *drop,
+            DelaySync: *delay,
+            MaxDelay: 200 * time.Millisecond,
+            CorruptSync: *corrupt,
+            StallSync: *stall,
+            StallFor: *nodeTimeout * 3 / 2,
+            KillTask: *kill,
+        }
+        clientChaos = append(clientChaos, chaos)
+
+        client := &silk.Client{
+            Version: 1,
+            ServerDomain: host,
+            ServerPort: port,
+            RetryBackoff: 50 * time.Millisecond,
+            MaxRetryBackoff: 500 * time.Millisecond,
+            Heartbeat: *nodeTimeout / 4,
+            Logger: logger,
+            Chaos: chaos,
+        }
+        // half the nodes come back as themselves after a timeout
+        if i % 2 == 0 {
+            client.Caps.Identity = fmt.Sprintf("chaos-node-%d", i)
+        }
+        go client.Run()
+    }
+
+    start := time.Now()
+    outcomes := make([]outcome, *tasks)
+    ended := make(chan outcome)
+    for i := range outcomes {
+        sub, err := server.SubmitTaskWith(Step{0, *steps}, silk.TaskOptions{})
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "silkchaos:", err)
+            os.Exit(1)
+        }
+        go func(i int) {
+            o := outcome{task: i, closed: true}
+            for checkpoint := range sub.Checkpoints {
+                if failure, ok := checkpoint.(silk.TaskFailed); ok {
+                    o.failed++
+                    o.reason = failure.Reason
+                } else if checkpoint.IsDone() {
+                    o.done++
+                }
+            }
+            ended <- o
+        }(i)
+    }
+
+    timeout := time.After(*deadline)
+    for waiting := *tasks; waiting > 0; waiting-- {
+        select {
+        case o := <-ended:
+            outcomes[o.task] = o
+        case <-timeout:
+            waiting = 0
+        }
+    }
+    elapsed := time.Since(start)
+
+    // tally up. streams which are still open count as unfinished
+    var once, failed, twice, unfinished []int
+    reasons := make(map[string]int)
+    for i, o := range outcomes {
+        switch {
+        case !o.closed:
+            unfinished = append(unfinished, i)
+        case o.done + o.failed > 1:
+            twice = append(twice, i)
+        case o.done == 1:
+            once = append(once, i)
+        case o.failed == 1:
+            failed = append(failed, i)
+            reasons[o.reason]++
+        default:
+            unfinished = append(unfinished, i)
+        }
+    }
+
+    fmt.Printf("seed %d: %d tasks of %d steps on %d nodes in %s\n", *seed, *tasks, *steps, *nodes, elapsed.Round(time.Millisecond))
+    stats := serverChaos.Stats()
+    fmt.Printf("server faults:   %s\n", faults(stats.Faults))
+    clientFaults := make(map[string]int)
+    for _, chaos := range clientChaos {
+        for fault, n := range chaos.Stats().Faults {
+            clientFaults[fault] += n
+        }
+    }
+    fmt.Printf("client faults:   %s\n", faults(clientFaults))
+    fmt.Printf("stale reports:   %d dropped\n", stats.StaleReports)
+    fmt.Printf("remembered:      %d\n", rememberedCount.Load())
+    fmt.Printf("finished once:   %d\n", len(once))
+    fmt.Printf("failed:          %d %s\n", len(failed), faults(reasons))
+    fmt.Printf("finished twice:  %d %v\n", len(twice), twice)
+    fmt.Printf("unfinished:      %d %v\n", len(unfinished), unfinished)
+
+    if len(twice) > 0 || len(unfinished) > 0 {
+        fmt.Println("FAIL")
+        os.Exit(1)
+    }
+    fmt.Println("OK")
+}
+
+func faults(counts map[string]int) string {
+    var names []string
+    for name := range counts {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var parts []string
+    for _, name := range names {
+        parts = append(parts, fmt.Sprintf("%s=%d", name, counts[name]))
+    }
+    return strings.Join(parts, " ")
+}
+
+func splitListen(addr string) (string, int) {
+    var port int
+    i := strings.LastIndex(addr, ":")
+    fmt.Sscan(addr[i+1:], &port)
+    return addr[:i], port
+}
@@ -0,0 +1,467 @@
+// silkctl talks to a silk server's json api
+//
+//   silkctl [-server URL] [-pool NAME] submit [-tenant T] [-priority N] [-key K]
+//       [-require K=V] [-avoid K=V] [-prefer K=V] [-spread GROUP [-spread-by LABEL]]
+//       [-follow] TYPE JSON
+//   silkctl [-server URL] [-pool NAME] tasks
+//   silkctl [-server URL] task ID
+//   silkctl [-server URL] result ID
+//   silkctl [-server URL] watch ID
+//   silkctl [-server URL] cancel ID
+//   silkctl [-server URL] [-pool NAME] nodes
+//   silkctl [-server URL] drain ID
+//   silkctl [-server URL] quarantine ID
+//   silkctl [-server URL] release ID
+//   silkctl [-server URL] health
+//   silkctl [-server URL] [-pool NAME] tenants
+//   silkctl [-server URL] pools
+//   silkctl [-server URL] usage [-csv] tasks|tenants|nodes
+//   silkctl [-server URL] events
+//
+// TYPE is the name of a type the server passed to RegisterTaskType, e.g.
+// main.Count, and JSON is the task itself.
+
+package main
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "flag"
+    "sort"
+    "bytes"
+    "time"
+    "strings"
+    "net/url"
+    "net/http"
+    "io/ioutil"
+    "encoding/json"
+    "text/tabwriter"
+
+    "github.com/rhelmot/golang-concurrency-supercool/audrey_examples/silk"
+)
+
+var server = flag.String("server", "http://localhost:8080", "base url of the silk server")
+var pool = flag.String("pool", "", "pool to submit to, or to list the tasks, nodes and tenants of")
+
+// ?pool= if -pool was given, so lists cover every pool otherwise
+func poolQuery() string {
+    query := ""
+    flag.Visit(func(f *flag.Flag) {
+        if f.Name == "pool" {
+            query = "?pool=" + url.QueryEscape(*pool)
+        }
+    })
+    return query
+}
+
+func main() {
+    flag.Usage = usage
+    flag.Parse()
+    args := flag.Args()
+    if len(args) == 0 {
+        usage()
+    }
+
+    var err error
+    switch args[0] {
+    case "submit":
+        err = submit(args[1:])
+    case "tasks":
+        err = tasks()
+    case "task":
+        err = task(arg(args, 1))
+    case "result":
+        err = result(arg(args, 1))
+    case "watch":
+        err = watch(arg(args, 1))
+    case "cancel":
+        err = post("/api/tasks/" + arg(args, 1) + "/cancel", nil, nil)
+    case "nodes":
+        err = nodes()
+    case "drain":
+        err = post("/api/nodes/" + arg(args, 1) + "/drain", nil, nil)
+    case "quarantine":
+        err = post("/api/nodes/" + arg(args, 1) + "/quarantine", nil, nil)
+    case "release":
+        err = post("/api/nodes/" + arg(args, 1) + "/release", nil, nil)
+    case "health":
+        err = health()
+    case "tenants":
+        err = tenants()
+    case "pools":
+        err = pools()
+    case "usage":
+        err = resources(args[1:])
+    case "events":
+        err = events()
+    default:
+        usage()
+    }
+
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "silkctl:", err)
+        os.Exit(1)
+    }
+}
+
+func usage() {
+    fmt.Fprintln(os.Stderr, "usage: silkctl [-server URL] submit|tasks|task|result|watch|cancel|nodes|drain|quarantine|release|health|tenants|pools|usage|events ...")
+    flag.PrintDefaults()
+    os.Exit(2)
+}
+
+func arg(args []string, i int) string {
+    if len(args) <= i {
+        usage()
+    }
+    return args[i]
+}
+
+func check(resp *http.Response) error {
+    if resp.StatusCode >= 400 {
+        body, _ := ioutil.ReadAll(resp.Body)
+        return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+    }
+    return nil
+}
+
+func get(path string, result interface{}) error {
+    resp, err := http.Get(*server + path)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    err = check(resp)
+    if err != nil {
+        return err
+    }
+    return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func post(path string, body interface{}, result interface{}) error {
+    buf := bytes.Buffer{}
+    if body != nil {
+        err := json.NewEncoder(&buf).Encode(body)
+        if err != nil {
+            return err
+        }
+    }
+
+    resp, err := http.Post(*server + path, "application/json", &buf)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    err = check(resp)
+    if err != nil || result == nil {
+        return err
+    }
+    return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// read a stream of json objects, one per line, until it ends
+func stream(path string, each func(json.RawMessage) error) error {
+    resp, err := http.Get(*server + path)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    err = check(resp)
+    if err != nil {
+        return err
+    }
+
+    d := json.NewDecoder(resp.Body)
+    for {
+        var line json.RawMessage
+        err = d.Decode(&line)
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        err = each(line)
+        if err != nil {
+            return err
+        }
+    }
+}
+
+func submit(args []string) error {
+    flags := flag.NewFlagSet("submit", flag.ExitOnError)
+    tenant := flags.String("tenant", "", "tenant to submit as")
+    priority := flags.Int("priority", 0, "priority within the tenant")
+    key := flags.String("key", "", "idempotency key")
+    follow := flags.Bool("follow", false, "stream checkpoints until the task ends")
+    require := labelFlag{}
+    avoid := labelFlag{}
+    prefer := labelFlag{}
+    flags.Var(require, "require", "only run on nodes with label K=V, repeatable")
+    flags.Var(avoid, "avoid", "never run on nodes with label K=V, repeatable")
+    flags.Var(prefer, "prefer", "rather run on nodes with label K=V, repeatable")
+    spread := flags.String("spread", "", "never run at once with tasks of this spread group on nodes sharing a -spread-by label")
+    spreadBy := flags.String("spread-by", "", "label to spread over, default the node's host")
+    flags.Parse(args)
+    if flags.NArg() != 2 {
+        usage()
+    }
+
+    req := silk.SubmitRequest{
+        Type: flags.Arg(0),
+        Task: json.RawMessage(flags.Arg(1)),
+        Tenant: *tenant,
+        Pool: *pool,
+        Priority: *priority,
+        IdempotencyKey: *key,
+        Placement: silk.Placement{
+            Require: require,
+            Avoid: avoid,
+            Prefer: prefer,
+            SpreadGroup: *spread,
+            SpreadBy: *spreadBy,
+        },
+    }
+    var resp silk.SubmitResponse
+    err := post("/api/tasks", &req, &resp)
+    if err != nil {
+        return err
+    }
+    fmt.Println(resp.Id)
+
+    if *follow {
+        return watch(fmt.Sprint(resp.Id))
+    }
+    return nil
+}
+
+func tasks() error {
+    var result []silk.TaskStatus
+    err := get("/api/tasks" + poolQuery(), &result)
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tTYPE\tTENANT\tPOOL\tSTATE\tNODE\tCHECKPOINTS\tSUBMITTED\tPROGRESS\tETA\tFAILURE")
+    for _, t := range result {
+        eta := "-"
+        if !t.ETA.IsZero() && t.State == silk.TaskRunning {
+            eta = t.ETA.Format("15:04:05")
+        }
+        fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", t.Id, t.Type, t.Tenant, t.Pool, t.State, idName(t.NodeId), t.Checkpoints, t.Submitted.Format("15:04:05"), progress(t.Progress), eta, t.Failure)
+    }
+    return w.Flush()
+}
+
+func task(id string) error {
+    var result json.RawMessage
+    err := get("/api/tasks/" + id, &result)
+    if err != nil {
+        return err
+    }
+    return printIndented(result)
+}
+
+func result(id string) error {
+    var result json.RawMessage
+    err := get("/api/tasks/" + id + "/result", &result)
+    if err != nil {
+        return err
+    }
+    return printIndented(result)
+}
+
+func watch(id string) error {
+    return stream("/api/tasks/" + id + "/checkpoints", func(line json.RawMessage) error {
+        var msg struct {
+            Type string
+            Checkpoint json.RawMessage
+        }
+        err := json.Unmarshal(line, &msg)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("%s %s\n", msg.Type, msg.Checkpoint)
+        return nil
+    })
+}
+
+func nodes() error {
+    var result []silk.NodeStatus
+    err := get("/api/nodes" + poolQuery(), &result)
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tADDR\tPOOL\tSITES\tMEM_MB\tCPUS\tTASK\tLAST_SEEN\tDRAINING\tQUARANTINED\tLABELS")
+    for _, n := range result {
+        fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%s\t%s\t%v\t%v\t%s\n", n.Id, n.Addr, n.Caps.Pool, n.Caps.CapSites, n.Caps.CapMemMB, n.Caps.CapCpus, idName(n.TaskId), n.LastSeen.Format("15:04:05"), n.Draining, n.Quarantined, labels(n.Caps.Labels))
+    }
+    return w.Flush()
+}
+
+func health() error {
+    var result []silk.NodeHealth
+    err := get("/api/health", &result)
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "MACHINE\tSCORE\tTIMEOUTS\tFAILURES\tSLOW_CHECKPOINTS\tQUARANTINED")
+    for _, h := range result {
+        quarantined := "-"
+        if h.Manual {
+            quarantined = "by hand"
+        } else if !h.QuarantinedUntil.IsZero() {
+            quarantined = "until " + h.QuarantinedUntil.Format("15:04:05")
+        }
+        fmt.Fprintf(w, "%s\t%.2f\t%d\t%d\t%d\t%s\n", h.Machine, h.Score, h.Timeouts, h.TaskFailures, h.SlowCheckpoints, quarantined)
+    }
+    return w.Flush()
+}
+
+func tenants() error {
+    var result map[string]silk.TenantUsage
+    err := get("/api/tenants" + poolQuery(), &result)
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "TENANT\tWEIGHT\tMAX_RUNNING\tQUEUED\tRUNNING\tSUBMITTED\tFINISHED")
+    for name, u := range result {
+        fmt.Fprintf(w, "%q\t%d\t%d\t%d\t%d\t%d\t%d\n", name, u.Weight, u.MaxRunning, u.Queued, u.Running, u.Submitted, u.Finished)
+    }
+    return w.Flush()
+}
+
+func resources(args []string) error {
+    flags := flag.NewFlagSet("usage", flag.ExitOnError)
+    asCsv := flags.Bool("csv", false, "print csv instead of a table")
+    flags.Parse(args)
+    if flags.NArg() != 1 {
+        usage()
+    }
+    by := flags.Arg(0)
+
+    if *asCsv {
+        resp, err := http.Get(*server + "/api/usage/" + by + "?format=csv")
+        if err != nil {
+            return err
+        }
+        defer resp.Body.Close()
+
+        err = check(resp)
+        if err != nil {
+            return err
+        }
+        _, err = io.Copy(os.Stdout, resp.Body)
+        return err
+    }
+
+    var result []silk.UsageRow
+    err := get("/api/usage/" + by, &result)
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "%s\tCPU\tWALL\tPEAK_RSS_KB\tREPORTS\n", strings.ToUpper(strings.TrimSuffix(by, "s")))
+    for _, row := range result {
+        fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", row.Key, row.Cpu.Round(time.Millisecond), row.Wall.Round(time.Millisecond), row.PeakRSSKB, row.Reports)
+    }
+    return w.Flush()
+}
+
+func pools() error {
+    var result []silk.PoolStatus
+    err := get("/api/pools", &result)
+    if err != nil {
+        return err
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "POOL\tVERSION\tNODE_TIMEOUT\tNODES\tQUEUED\tRUNNING\tTENANTS")
+    for _, p := range result {
+        fmt.Fprintf(w, "%q\t%d\t%s\t%d\t%d\t%d\t%d\n", p.Name, p.Version, p.NodeTimeout, p.Nodes, p.Queued, p.Running, len(p.Tenants))
+    }
+    return w.Flush()
+}
+
+func events() error {
+    return stream("/api/events", func(line json.RawMessage) error {
+        var e silk.Event
+        err := json.Unmarshal(line, &e)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("%s %-18s node=%s task=%s %s\n", e.Time.Format("15:04:05.000"), e.Kind, idName(e.NodeId), idName(e.TaskId), e.Message)
+        return nil
+    })
+}
+
+// K=V flags which may be given more than once
+type labelFlag map[string]string
+
+func (self labelFlag) String() string {
+    return labels(self)
+}
+
+func (self labelFlag) Set(value string) error {
+    k, v, ok := strings.Cut(value, "=")
+    if !ok {
+        return fmt.Errorf("expected K=V, got %q", value)
+    }
+    self[k] = v
+    return nil
+}
+
+func labels(m map[string]string) string {
+    var parts []string
+    for k, v := range m {
+        parts = append(parts, k + "=" + v)
+    }
+    sort.Strings(parts)
+    return strings.Join(parts, ",")
+}
+
+// ids of -1 mean none
+func progress(p *silk.TaskProgress) string {
+    if p == nil {
+        return "-"
+    }
+    var parts []string
+    if p.Fraction >= 0 {
+        parts = append(parts, fmt.Sprintf("%.0f%%", 100 * p.Fraction))
+    }
+    if p.Stage != "" {
+        parts = append(parts, p.Stage)
+    }
+    if len(parts) == 0 {
+        return "-"
+    }
+    return strings.Join(parts, " ")
+}
+
+func idName(id int) string {
+    if id == -1 {
+        return "-"
+    }
+    return fmt.Sprint(id)
+}
+
+func printIndented(raw json.RawMessage) error {
+    buf := bytes.Buffer{}
+    err := json.Indent(&buf, raw, "", "  ")
+    if err != nil {
+        return err
+    }
+    fmt.Println(buf.String())
+    return nil
+}
@@ -0,0 +1,272 @@
+// silkreplay feeds a silk server's RecordFile into a fresh server, playing
+// the recorded nodes' side of every /sync exchange, and shows where the
+// fresh server's scheduling decisions differ from the recorded ones
+//
+//   silkreplay [-step] [-speed F] [-node-timeout D] [-v] FILE
+//
+// tasks are replaced with placeholders of the recorded type names, so the
+// program that recorded doesn't need to be at hand. -step waits for enter
+// before each exchange. -speed 1 replays in real time, which node timeouts
+// need to turn out as recorded; the default replays as fast as it can
+
+package main
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "time"
+    "bytes"
+    "bufio"
+    "log/slog"
+    "encoding/gob"
+    "net/http/httptest"
+
+    "github.com/rhelmot/golang-concurrency-supercool/audrey_examples/silk"
+)
+
+var step = flag.Bool("step", false, "wait for enter before each exchange")
+var speed = flag.Float64("speed", 0, "replay at this multiple of real time, 0 for as fast as possible")
+var nodeTimeout = flag.Duration("node-timeout", 24 * time.Hour, "NodeTimeout of the fresh server")
+var verbose = flag.Bool("v", false, "log what the fresh server gets up to")
+
+// stands in for a recorded task
+type Placeholder struct {
+    Type string
+    Done bool
+}
+
+func (self Placeholder) IsDone() bool {
+    return self.Done
+}
+
+func (self Placeholder) Run(progress chan silk.Task, cancel chan bool) {
+    <-cancel
+}
+
+// what goes over the wire after a SyncRequest or SyncResponse
+type wireTask struct {
+    TaskId int
+    Task silk.Task
+}
+
+// recorded ids to the fresh server's. they usually match, but needn't
+type idMap map[int]int
+
+func (self idMap) get(id int) int {
+    if id == -1 {
+        return -1
+    }
+    if mapped, ok := self[id]; ok {
+        return mapped
+    }
+    return id
+}
+
+func main() {
+    flag.Usage = func() {
+        fmt.Fprintln(os.Stderr, "usage: silkreplay [flags] FILE")
+        flag.PrintDefaults()
+        os.Exit(2)
+    }
+    flag.Parse()
+    if flag.NArg() != 1 {
+        flag.Usage()
+    }
+    silk.RegisterTaskType(Placeholder{})
+
+    records, err := silk.ReadRecording(flag.Arg(0))
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "silkreplay:", err)
+        os.Exit(1)
+    }
+
+    // come up as the recorded server, with the pools it had, so nodes'
+    // ServerIds and Versions match
+    server := &silk.Server{Listen: "127.0.0.1:0", NodeTimeout: *nodeTimeout, Pools: make(map[string]silk.PoolConfig)}
+    for _, rec := range records {
+        if rec.Request == nil || rec.Response == nil {
+            continue
+        }
+        if server.ServerId == 0 {
+            server.ServerId = rec.Response.ServerId
+        }
+        if rec.Request.Caps.Pool == silk.DefaultPool {
+            server.Version = rec.Response.Version
+        } else {
+            server.Pools[rec.Request.Caps.Pool] = silk.PoolConfig{Version: rec.Response.Version}
+        }
+    }
+    for _, rec := range records {
+        if _, ok := server.Pools[rec.Pool]; rec.Kind == "submit" && rec.Pool != silk.DefaultPool && !ok {
+            server.Pools[rec.Pool] = silk.PoolConfig{}
+        }
+    }
+    level := slog.LevelError
+    if *verbose {
+        level = slog.LevelInfo
+    }
+    server.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+    joined, remembered := server.Serve()
+    go func() {
+        for range joined {
+        }
+    }()
+    go func() {
+        for range remembered {
+        }
+    }()
+
+    tasks := make(idMap)
+    nodes := make(idMap)
+    stdin := bufio.NewReader(os.Stdin)
+    var last time.Time
+    exchanges, diverged, skipped := 0, 0, 0
+
+    for i, rec := range records {
+        if *speed > 0 && !last.IsZero() && rec.Time.After(last) {
+            time.Sleep(time.Duration(float64(rec.Time.Sub(last)) / *speed))
+        }
+        last = rec.Time
+
+        switch rec.Kind {
+        case "submit":
+            t := Placeholder{rec.Task.Type, false}
+            sub, err := server.SubmitTaskWith(t, silk.TaskOptions{Tenant: rec.Tenant, Pool: rec.Pool, Priority: rec.Priority, Placement: rec.Placement})
+            if err != nil {
+                fmt.Printf("#%d submit task %d failed: %s\n", i, rec.TaskId, err)
+                continue
+            }
+            tasks[rec.TaskId] = sub.Id
+            go func() {
+                for range sub.Checkpoints {
+                }
+            }()
+            fmt.Printf("#%d %s submit task %d %s tenant=%q priority=%d\n", i, rec.Time.Format("15:04:05.000"), rec.TaskId, rec.Task.Type, rec.Tenant, rec.Priority)
+        case "cancel":
+            server.CancelTask(tasks.get(rec.TaskId))
+            fmt.Printf("#%d %s cancel task %d\n", i, rec.Time.Format("15:04:05.000"), rec.TaskId)
+        case "sync":
+            if rec.Request == nil || rec.Response == nil {
+                // rejected, and we can't reproduce what was wrong with it
+                skipped++
+                continue
+            }
+            if *step {
+                fmt.Printf("#%d next: %s. enter to go on ", i, describeRequest(rec))
+                stdin.ReadString('\n')
+            }
+
+            resp, sent, err := replay(server, rec, tasks, nodes)
+            exchanges++
+            if err != nil {
+                fmt.Printf("#%d replay failed: %s\n", i, err)
+                diverged++
+                continue
+            }
+            if rec.Response.NodeId != -1 {
+                nodes[rec.Response.NodeId] = resp.NodeId
+            }
+
+            recorded := describeResponse(*rec.Response, rec.Sent, tasks)
+            replayed := describeResponse(resp, sent, nil)
+            mark := ""
+            if recorded != replayed {
+                mark = "  <-- DIVERGED"
+                diverged++
+            }
+            fmt.Printf("#%d %s %s\n    recorded: %s\n    replayed: %s%s\n", i, rec.Time.Format("15:04:05.000"), describeRequest(rec), recorded, replayed, mark)
+        }
+    }
+
+    fmt.Printf("%d exchanges replayed, %d diverged, %d rejected ones skipped\n", exchanges, diverged, skipped)
+    if diverged > 0 {
+        os.Exit(1)
+    }
+}
+
+// play the node's side of one recorded exchange against server
+func replay(server *silk.Server, rec silk.SyncRecord, tasks idMap, nodes idMap) (silk.SyncResponse, *silk.TaskRef, error) {
+    req := *rec.Request
+    req.Caps.NodeId = nodes.get(req.Caps.NodeId)
+    req.Term = 0 // the fresh server was never taken over from
+
+    buf := bytes.Buffer{}
+    e := gob.NewEncoder(&buf)
+    err := e.Encode(&req)
+    if err != nil {
+        return silk.SyncResponse{}, nil, err
+    }
+    if req.Caps.NodeId != -1 {
+        wire := wireTask{-1, nil}
+        if rec.Reported != nil {
+            wire.TaskId = tasks.get(rec.Reported.Id)
+            if rec.Reported.Type != "" {
+                wire.Task = Placeholder{rec.Reported.Type, rec.Reported.Done}
+            }
+        }
+        err = e.Encode(&wire)
+        if err != nil {
+            return silk.SyncResponse{}, nil, err
+        }
+    }
+
+    r := httptest.NewRequest("POST", "/sync", &buf)
+    r.RemoteAddr = rec.RemoteAddr
+    w := httptest.NewRecorder()
+    server.ServeHTTP(w, r)
+    if w.Code >= 400 {
+        return silk.SyncResponse{}, nil, fmt.Errorf("HTTP %d: %s", w.Code, w.Body.String())
+    }
+
+    var resp silk.SyncResponse
+    var sent wireTask
+    d := gob.NewDecoder(w.Body)
+    err = d.Decode(&resp)
+    if err != nil {
+        return resp, nil, err
+    }
+    err = d.Decode(&sent)
+    if err != nil {
+        return resp, nil, err
+    }
+
+    ref := &silk.TaskRef{Id: sent.TaskId}
+    if placeholder, ok := sent.Task.(Placeholder); ok {
+        ref.Type = placeholder.Type
+        ref.Done = placeholder.Done
+    }
+    return resp, ref, nil
+}
+
+func describeRequest(rec silk.SyncRecord) string {
+    s := fmt.Sprintf("node %d (%s)", rec.Request.Caps.NodeId, rec.RemoteAddr)
+    switch {
+    case rec.Reported == nil:
+        s += " joins"
+    case rec.Request.Failure != "":
+        s += fmt.Sprintf(" reports task %d failed: %s", rec.Reported.Id, rec.Request.Failure)
+    case rec.Reported.Id == -1:
+        s += " is idle"
+    case rec.Reported.Type == "":
+        s += fmt.Sprintf(" is still on task %d", rec.Reported.Id)
+    case rec.Reported.Done:
+        s += fmt.Sprintf(" finished task %d", rec.Reported.Id)
+    default:
+        s += fmt.Sprintf(" checkpoints task %d", rec.Reported.Id)
+    }
+    return s
+}
+
+// in the fresh server's ids, mapping recorded ones through tasks if given
+func describeResponse(resp silk.SyncResponse, sent *silk.TaskRef, tasks idMap) string {
+    id := -1
+    if sent != nil {
+        id = sent.Id
+        if tasks != nil {
+            id = tasks.get(id)
+        }
+    }
+    return fmt.Sprintf("%q node=%d task=%d", resp.Message, resp.NodeId, id)
+}
@@ -0,0 +1,327 @@
+package silk
+
+import (
+    "fmt"
+    "sort"
+    "time"
+)
+
+const (
+    TaskQueued = "queued"
+    TaskRunning = "running"
+    TaskDone = "done"
+    TaskFailedState = "failed"
+    TaskCancelled = "cancelled"
+)
+
+// how many ended tasks stay visible in Tasks()
+const endedTaskHistory = 1000
+
+// what the server knows about a task
+type TaskStatus struct {
+    Id int
+    Type string
+    Tenant string
+    Pool string
+    State string
+    NodeId int // -1 unless running
+    Submitted time.Time
+    LastCheckpoint time.Time
+    Checkpoints int
+    Failure string
+    Usage ResourceUsage // as reported by the nodes which ran it
+    Progress *TaskProgress // latest, nil unless the task implements Progress
+    ETA time.Time // zero if it can't be estimated yet
+}
+
+// what the server knows about a node
+type NodeStatus struct {
+    Id int
+    Caps ClientCaps
+    Addr string
+    Joined time.Time // first time, for nodes with an Identity
+    LastSeen time.Time
+    Rejoins int // times a node with an Identity came back
+    TaskId int // -1 if idle
+    Draining bool
+    Quarantined bool // the machine it runs on is, see Server.Health
+}
+
+// must hold taskLock. keep the task table from growing without bound
+func (self *Server) forgetEndedTasks() {
+    for len(self.endedTasks) > endedTaskHistory {
+        delete(self.tasks, self.endedTasks[0])
+        self.endedTasks = self.endedTasks[1:]
+    }
+}
+
+// returns the trace context the node should run the task under
+func (self *Server) taskDispatched(id int, nodeId int) TraceContext {
+    var trace TraceContext
+    var spans spanBatch
+
+    self.taskLock.Lock()
+    rec, ok := self.tasks[id]
+    // a task cancelled while waiting for room in the queue can still be
+    // taken before it's taken back out
+    if ok && !rec.over() {
+        rec.status.State = TaskRunning
+        rec.status.NodeId = nodeId
+
+        spans.finish(rec.queuedSpan)
+        rec.queuedSpan = nil
+        rec.attemptSpan = startSpan(rec.span.context(), "attempt", "node_id", fmt.Sprint(nodeId))
+        rec.lastReport = rec.attemptSpan.Start
+        trace = rec.attemptSpan.context()
+    }
+    self.taskLock.Unlock()
+    spans.export(self.SpanExporter)
+
+    self.events.emit(EventTaskDispatched, nodeId, id, "")
+    self.journal.emit(journalEntry{Kind: journalDispatch, TaskId: id, NodeId: nodeId})
+    return trace
+}
+
+// the node went away or lost track of taskId. if the task was still the
+// node's, put it back in line from checkpoint
+func (self *Server) nodeLost(nodeId int, taskId int) {
+    if taskId == -1 {
+        return
+    }
+
+    self.taskLock.Lock()
+    rec, ok := self.tasks[taskId]
+    self.taskLock.Unlock()
+
+    if ok {
+        self.taskLost(rec, nodeId)
+    }
+}
+
+// the task last dispatched to nodeId, if it's still the node's, as it was
+// sent. for when the reply carrying it was lost
+func (self *Server) undeliveredTask(id int, nodeId int) (taskWithId, TraceContext, bool) {
+    self.taskLock.Lock()
+    defer self.taskLock.Unlock()
+
+    rec, ok := self.tasks[id]
+    if !ok || rec.status.State != TaskRunning || rec.status.NodeId != nodeId {
+        return taskWithId{-1, nil}, TraceContext{}, false
+    }
+    t := rec.latest
+    if t == nil {
+        t = rec.submitted
+    }
+    return taskWithId{id, t}, rec.attemptSpan.context(), true
+}
+
+// a node sent a checkpoint or a failure of task id in req. the checkpoint
+// span goes under the node's span for the task, if it sent one
+// returns the time since the attempt's last report
+func (self *Server) taskReported(id int, req *SyncRequest) time.Duration {
+    var spans spanBatch
+    defer func() {
+        spans.export(self.SpanExporter)
+    }()
+
+    self.taskLock.Lock()
+    defer self.taskLock.Unlock()
+
+    rec, ok := self.tasks[id]
+    if !ok || rec.attemptSpan == nil {
+        return 0
+    }
+    trace := req.Trace
+    if !trace.Valid() {
+        trace = rec.attemptSpan.context()
+    }
+
+    span := startSpan(trace, "checkpoint", "task_id", fmt.Sprint(id))
+    span.Start = rec.lastReport
+    if req.Failure != "" {
+        span.set("failure", req.Failure)
+    }
+    if req.Usage.Reports > 0 {
+        span.set("cpu_seconds", fmt.Sprintf("%.3f", req.Usage.Cpu.Seconds()))
+        span.set("peak_rss_kb", fmt.Sprint(req.Usage.PeakRSSKB))
+    }
+    spans.finish(span)
+    self.taskUsed(rec, req.Usage)
+    rec.progressed(req.Progress, span.End)
+    interval := span.End.Sub(rec.lastReport)
+    rec.lastReport = span.End
+    return interval
+}
+
+func (self *Server) taskCheckpointed(rec *taskRecord, checkpoint Task) {
+    self.taskLock.Lock()
+    rec.status.Checkpoints++
+    rec.status.LastCheckpoint = time.Now()
+    rec.latest = checkpoint
+    self.taskLock.Unlock()
+
+    // the end of the task is journaled by taskEnded
+    if !checkpoint.IsDone() {
+        self.journal.emit(journalEntry{Kind: journalTask, TaskId: rec.id, Task: checkpoint, Tenant: rec.status.Tenant, Pool: rec.pool.name, Priority: rec.priority, Placement: rec.placement})
+    }
+}
+
+// must hold rec.lock. the spans it ends go in spans
+func (self *Server) taskRequeued(rec *taskRecord, spans *spanBatch) {
+    self.taskLock.Lock()
+    nodeId := rec.status.NodeId
+    rec.status.State = TaskQueued
+    rec.status.NodeId = -1
+    rec.progressReset()
+
+    rec.attemptSpan.set("outcome", "node went away")
+    spans.finish(rec.attemptSpan)
+    rec.attemptSpan = nil
+    reschedule := startSpan(rec.span.context(), "reschedule", "node_id", fmt.Sprint(nodeId), "reason", "node went away")
+    spans.finish(reschedule)
+    rec.queuedSpan = startSpan(rec.span.context(), "queued")
+    self.taskLock.Unlock()
+
+    self.events.emit(EventTaskRescheduled, nodeId, rec.id, "node went away")
+    self.journal.emit(journalEntry{Kind: journalRequeue, TaskId: rec.id})
+}
+
+// must hold rec.lock. the spans it ends go in spans
+func (self *Server) taskEnded(rec *taskRecord, final Task, spans *spanBatch) {
+    self.taskLock.Lock()
+    nodeId := rec.status.NodeId
+    rec.status.NodeId = -1
+    if failure, ok := final.(TaskFailed); ok {
+        rec.status.State = TaskFailedState
+        rec.status.Failure = failure.Reason
+    } else if final != nil && final.IsDone() {
+        rec.status.State = TaskDone
+    } else {
+        rec.status.State = TaskCancelled
+    }
+    state := rec.status.State
+    failure := rec.status.Failure
+
+    spans.finish(rec.queuedSpan)
+    rec.attemptSpan.set("outcome", state)
+    spans.finish(rec.attemptSpan)
+    rec.queuedSpan, rec.attemptSpan = nil, nil
+    rec.span.set("state", state)
+    if failure != "" {
+        rec.span.set("failure", failure)
+    }
+    spans.finish(rec.span)
+
+    self.endedTasks = append(self.endedTasks, rec.id)
+    self.forgetEndedTasks()
+    self.taskLock.Unlock()
+
+    self.journal.emit(journalEntry{Kind: journalEnd, TaskId: rec.id})
+
+    switch state {
+    case TaskDone:
+        self.events.emit(EventTaskDone, nodeId, rec.id, "")
+    case TaskFailedState:
+        self.events.emit(EventTaskFailed, nodeId, rec.id, failure)
+    default:
+        self.events.emit(EventTaskCancelled, nodeId, rec.id, "")
+    }
+}
+
+// all tasks which are still going plus recently ended ones, by id
+func (self *Server) Tasks() []TaskStatus {
+    var result []TaskStatus
+
+    self.taskLock.Lock()
+    for _, rec := range self.tasks {
+        result = append(result, rec.status)
+    }
+    self.taskLock.Unlock()
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].Id < result[j].Id
+    })
+    return result
+}
+
+// status and latest checkpoint of one task
+func (self *Server) TaskInfo(id int) (TaskStatus, Task, bool) {
+    self.taskLock.Lock()
+    defer self.taskLock.Unlock()
+
+    rec, ok := self.tasks[id]
+    if !ok {
+        return TaskStatus{}, nil, false
+    }
+    return rec.status, rec.latest, true
+}
+
+// follow a task which was submitted elsewhere, e.g. through the http api
+func (self *Server) Attach(id int) (*Submission, error) {
+    self.taskLock.Lock()
+    rec, ok := self.tasks[id]
+    self.taskLock.Unlock()
+
+    if !ok {
+        // long gone, but we may still know how it ended
+        result, found, err := self.Result(id)
+        if err != nil || !found {
+            return nil, fmt.Errorf("no such task %d", id)
+        }
+        checkpoints := make(chan Task, 1)
+        if result.Final != nil {
+            checkpoints <- result.Final
+        }
+        close(checkpoints)
+        return &Submission{id, checkpoints, TraceContext{}, self, &taskRecord{id: id, ended: true}}, nil
+    }
+    return rec.attach(self), nil
+}
+
+func (self *Server) CancelTask(id int) error {
+    self.taskLock.Lock()
+    rec, ok := self.tasks[id]
+    self.taskLock.Unlock()
+
+    if !ok {
+        return fmt.Errorf("no such task %d", id)
+    }
+    self.taskCancelled(rec)
+    return nil
+}
+
+// all live nodes, by id
+func (self *Server) Nodes() []NodeStatus {
+    var result []NodeStatus
+
+    self.nodeLock.Lock()
+    for _, node := range self.nodes {
+        result = append(result, *node)
+    }
+    self.nodeLock.Unlock()
+
+    for i := range result {
+        result[i].Quarantined = self.machineQuarantined(machine(result[i].Caps))
+    }
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].Id < result[j].Id
+    })
+    return result
+}
+
+// stop handing new tasks to a node. whatever it's running is left alone
+func (self *Server) DrainNode(id int) error {
+    self.nodeLock.Lock()
+    node, ok := self.nodes[id]
+    if ok {
+        node.Draining = true
+    }
+    self.nodeLock.Unlock()
+
+    if !ok {
+        return fmt.Errorf("no such node %d", id)
+    }
+    self.events.emit(EventNodeDraining, id, -1, "")
+    return nil
+}
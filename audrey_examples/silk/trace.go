@@ -0,0 +1,158 @@
+package silk
+
+import (
+    "os"
+    "sync"
+    "time"
+    "encoding/hex"
+    "encoding/json"
+    "crypto/rand"
+)
+
+// identifies a span, and the trace it belongs to. the zero value means no
+// trace. carried in SyncRequest and SyncResponse so spans recorded by clients
+// and servers can be joined up
+type TraceContext struct {
+    TraceId string
+    SpanId string
+}
+
+func (self TraceContext) Valid() bool {
+    return self.TraceId != "" && self.SpanId != ""
+}
+
+// one timed piece of a task's life. the spans a server records for a task are
+//   task        submission until the task ends
+//   queued      every stretch spent waiting in the queue
+//   attempt     dispatch to one node until it finishes, fails or goes away
+//   checkpoint  the time since the last checkpoint of an attempt
+//   reschedule  an instant, when an attempt is given up on
+// and clients record a run span per Task.Run under the attempt
+type Span struct {
+    TraceId string
+    SpanId string
+    ParentId string // empty for the root of a trace
+    Name string
+    Start time.Time
+    End time.Time
+    Attrs map[string]string
+}
+
+// where finished spans go. the server never calls ExportSpan while holding
+// its locks, but a slow exporter still holds up whatever ended the span
+type SpanExporter interface {
+    ExportSpan(span Span)
+}
+
+// begin a span under parent, or a new trace if parent isn't valid
+// attrs are key, value pairs
+func startSpan(parent TraceContext, name string, attrs ...string) *Span {
+    span := &Span{
+        TraceId: parent.TraceId,
+        SpanId: randomId(8),
+        ParentId: parent.SpanId,
+        Name: name,
+        Start: time.Now(),
+        Attrs: make(map[string]string),
+    }
+    if !parent.Valid() {
+        span.TraceId = randomId(16)
+        span.ParentId = ""
+    }
+    for i := 0; i + 1 < len(attrs); i += 2 {
+        span.Attrs[attrs[i]] = attrs[i + 1]
+    }
+    return span
+}
+
+// a nil span has no context
+func (self *Span) context() TraceContext {
+    if self == nil {
+        return TraceContext{}
+    }
+    return TraceContext{self.TraceId, self.SpanId}
+}
+
+func (self *Span) set(key string, value string) {
+    if self != nil {
+        self.Attrs[key] = value
+    }
+}
+
+// end the span and hand it to the exporter, if there is one
+func (self *Span) finish(exporter SpanExporter) {
+    if self == nil {
+        return
+    }
+    self.End = time.Now()
+    if exporter != nil {
+        exporter.ExportSpan(*self)
+    }
+}
+
+// spans ended while holding a lock, to be exported once it's released, so
+// a slow exporter doesn't hold up everyone else waiting on the lock
+type spanBatch []Span
+
+// end the span now, export it later
+func (self *spanBatch) finish(span *Span) {
+    if span == nil {
+        return
+    }
+    span.End = time.Now()
+    *self = append(*self, *span)
+}
+
+func (self spanBatch) export(exporter SpanExporter) {
+    if exporter == nil {
+        return
+    }
+    for _, span := range self {
+        exporter.ExportSpan(span)
+    }
+}
+
+func randomId(size int) string {
+    buf := make([]byte, size)
+    rand.Read(buf)
+    return hex.EncodeToString(buf)
+}
+
+// writes spans to a file as json, one per line, so traces can be looked at
+// without any tracing infrastructure
+type JsonFileExporter struct {
+    lock sync.Mutex
+    file *os.File
+    encoder *json.Encoder
+}
+
+// appends to path, creating it if need be
+func NewJsonFileExporter(path string) (*JsonFileExporter, error) {
+    f, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &JsonFileExporter{file: f, encoder: json.NewEncoder(f)}, nil
+}
+
+func (self *JsonFileExporter) ExportSpan(span Span) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if self.file != nil {
+        self.encoder.Encode(span)
+    }
+}
+
+// spans exported after Close are dropped
+func (self *JsonFileExporter) Close() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    f := self.file
+    self.file = nil
+    if f == nil {
+        return nil
+    }
+    return f.Close()
+}
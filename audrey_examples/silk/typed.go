@@ -0,0 +1,128 @@
+package silk
+
+import (
+    "fmt"
+    "errors"
+)
+
+// A task written against typed checkpoints and a typed result. The job value
+// itself is the task's input. Run resumes from resume if it isn't nil, calls
+// checkpoint as it makes progress and returns its result, or false if it saw
+// cancel and gave up.
+type Job[C, R any] interface {
+    Run(resume *C, checkpoint func(C), cancel chan bool) (R, bool)
+}
+
+// adapts a Job to the Task interface. this is what goes over the wire, so it
+// works with clients and servers which only know about plain Tasks
+type TypedTask[J Job[C, R], C, R any] struct {
+    Job J
+    Checkpoint C
+    Resumed bool // Checkpoint is valid
+    Result R
+    Done bool
+}
+
+func (self TypedTask[J, C, R]) IsDone() bool {
+    return self.Done
+}
+
+func (self TypedTask[J, C, R]) Run(progress chan Task, cancel chan bool) {
+    var resume *C
+    if self.Resumed {
+        resume = &self.Checkpoint
+    }
+
+    checkpoint := func(c C) {
+        self.Checkpoint = c
+        self.Resumed = true
+        select {
+        case progress <- self:
+        case <-cancel:
+        }
+    }
+
+    result, ok := self.Job.Run(resume, checkpoint, cancel)
+    if !ok {
+        return
+    }
+
+    self.Result = result
+    self.Done = true
+    select {
+    case progress <- self:
+    case <-cancel:
+    }
+}
+
+// the end of a typed task
+type Outcome[R any] struct {
+    Value R
+    Err error
+}
+
+var ErrCancelled = errors.New("task was cancelled")
+
+// register a job type with gob. Submit does this for you, but nodes which
+// only run jobs have to call it, like RegisterTaskType
+func RegisterJob[J Job[C, R], C, R any](job J) {
+    RegisterTaskType(TypedTask[J, C, R]{})
+}
+
+// typed version of SubmitTask. the checkpoint channel yields progress and is
+// closed when the task ends, after which the outcome channel yields exactly
+// once. sending true on or closing the bool channel cancels the task
+// like Submission.Checkpoints, the checkpoint channel only ever holds the
+// latest checkpoint, so reading just the outcome is fine
+func Submit[J Job[C, R], C, R any](server *Server, job J, block bool) (chan C, chan Outcome[R], chan bool) {
+    RegisterJob[J, C, R](job)
+
+    checkpoints := make(chan C, 1)
+    outcome := make(chan Outcome[R], 1)
+    cancel := make(chan bool, 1)
+
+    task := TypedTask[J, C, R]{Job: job}
+    sub, err := server.SubmitTaskWith(task, TaskOptions{Block: block})
+    if err != nil {
+        sub = server.failedSubmission(task, err)
+    }
+
+    // watches cancel too, so the task needs no other goroutine
+    go func() {
+        var result Outcome[R]
+        result.Err = ErrCancelled
+        cancelling := cancel
+
+        for {
+            var t Task
+            var ok bool
+            select {
+            case t, ok = <-sub.Checkpoints:
+            case <-cancelling:
+                cancelling = nil
+                sub.Cancel()
+                continue
+            }
+            if !ok {
+                break
+            }
+
+            switch t := t.(type) {
+            case TypedTask[J, C, R]:
+                if t.Done {
+                    result = Outcome[R]{t.Result, nil}
+                } else if t.Resumed {
+                    offer(checkpoints, t.Checkpoint)
+                }
+            case TaskFailed:
+                result.Err = fmt.Errorf("task failed: %s", t.Reason)
+            }
+        }
+
+        close(checkpoints)
+        outcome <- result
+        close(outcome)
+    }()
+
+    return checkpoints, outcome, cancel
+}
@@ -2,7 +2,10 @@ package silk
 
 import (
     "sync"
+    "sync/atomic"
     "time"
+    "reflect"
+    "log/slog"
     "net/http"
     "encoding/gob"
 )
@@ -18,12 +21,23 @@ type ClientCaps struct {
     CapMemMB int
     CapCpus int
     CapLifetime time.Duration
+    Labels map[string]string // free form, e.g. region, for Placement
+    Pool string // which of the server's Pools to join, DefaultPool if ""
+
+    // unique to the node and kept across restarts, so the server knows it
+    // when it comes back. see Client.IdentityFile
+    Identity string
 }
 
 type SyncRequest struct {
     Version int
     ServerId int
     Caps ClientCaps
+    Failure string // set if the task on the wire crashed instead of checkpointing
+    Trace TraceContext // the client's span for the task on the wire
+    Usage ResourceUsage // what the task on the wire used since the last report
+    Progress *TaskProgress // of the task on the wire, if it implements Progress
+    Term int // the highest SyncResponse.Term the node has seen from ServerId
 }
 
 type SyncResponse struct {
@@ -31,6 +45,12 @@ type SyncResponse struct {
     ServerId int
     NodeId int
     Message string
+    Trace TraceContext // the attempt span of a newly dispatched task
+
+    // goes up by one every time a standby takes over under ServerId. nodes
+    // ignore replies with a lower Term than they've seen, and an active
+    // server which hears of a higher one stands down
+    Term int
 }
 
 type Server struct {
@@ -38,34 +58,203 @@ type Server struct {
     Listen string
     NodeTimeout time.Duration
     ServerId int
+    ScheduleFile string // where recurring tasks are persisted, "" to not persist
+    Tenants map[string]TenantConfig // tenants not listed get the defaults
+    IdempotencyWindow time.Duration // how long keys are kept after their task ends
+    QueueCapacity int // most tasks waiting for a node at once, 0 for unbounded
+    Admission AdmissionPolicy // what happens to submissions beyond QueueCapacity
+
+    // pools besides DefaultPool, by name. each has its own nodes, tasks and
+    // settings. nodes join one with Caps.Pool, tasks go to one with
+    // TaskOptions.Pool
+    Pools map[string]PoolConfig
+    Logger *slog.Logger // defaults to slog.Default()
+    SpanExporter SpanExporter // nil to drop spans
+    Chaos *Chaos // faults to inject, for testing. nil for none
+
+    // append every submission, cancellation and /sync exchange here, to be
+    // replayed with silkreplay. "" to not record
+    RecordFile string
+
+    // run as a standby of the active server at this address ("host:port"),
+    // replicating its tasks, nodes, idempotency keys and schedules, and
+    // taking over under its ServerId if it's unreachable for FailoverTimeout.
+    // an active server which finds out it was taken over from, because a
+    // node has synced with the new one, stands by and turns nodes away. it
+    // goes back to replicating if it has a Standby address of its own, or
+    // stays out of the way until it's restarted otherwise
+    Standby string
+    FailoverTimeout time.Duration // default 5s
+
+    // UDP address to announce this server on so clients can find it, e.g.
+    // a multicast group like "239.83.73.76:7946" or a broadcast address. ""
+    // to not announce. announcements start every second and back off to
+    // every 30s, and start over when the server takes over or stands down
+    Announce string
+
+    // hosts whose nodes keep timing out or failing tasks get no new tasks for
+    // QuarantineCooldown (default 10m) once their health score reaches
+    // QuarantineScore (default 3). checkpoints further apart than
+    // SlowCheckpoint count a little against a host too, 0 to not count them
+    QuarantineScore float64
+    QuarantineCooldown time.Duration
+    SlowCheckpoint time.Duration
+
+    // where results of ended tasks are kept, see Server.Result. by default
+    // they're kept in memory for ResultRetention (default 24h), at most
+    // MaxResults (default 10000) of them
+    Results ResultStore
+    ResultRetention time.Duration
+    MaxResults int
 
     serving bool
+    logger atomic.Pointer[slog.Logger] // see log()
+    recorder *recorder
+
+    haLock sync.Mutex
+    active bool // false while standing by
+    reannounce chan bool // see announceChanged
+    term int // see SyncResponse.Term
+    journal *journal
 
-    taskQueue chan taskWithId
+    pools map[string]*pool
     rememberedTasks chan Task
     nodeEvents chan ClientCaps
 
     taskLock sync.Mutex
-    taskProgressMap map[int]chan Task
+    tasks map[int]*taskRecord
+    endedTasks []int
     nextTaskId int
 
     nodeLock sync.Mutex
-    nodeHeartbeatMap map[int]chan int
+    nodes map[int]*NodeStatus
+    nodeDeadlines map[int]*nodeDeadline // of live nodes, by id
+    deadlines deadlineHeap
+    wake chan bool // see wakeScheduler
     nextNodeId int
+    identities map[string]int // node Identity to id, departed nodes included
+    departed map[int]NodeStatus // nodes with an Identity which timed out
+
+    cancelLock sync.Mutex
+    cancelChanges []cancelChange // for the scheduler to pick up
+
+    events *eventLog
+    depth depthSampler
+
+    scheduleLock sync.Mutex
+    schedules map[string]*recurring
+
+    keyLock sync.Mutex
+    keys map[string]*keyedTask
+    expiringKeys []*keyedTask // keys of ended tasks, soonest to expire first
+
+    healthLock sync.Mutex
+    health map[string]*NodeHealth
+
+    // under taskLock, since the server started
+    tenantResources map[string]*ResourceUsage
+    nodeResources map[int]*ResourceUsage
+}
+
+// everything about a submission beyond the task itself
+type TaskOptions struct {
+    Block bool // wait until some node has taken the task, or it ends first
+    Tenant string // who is submitting, for fair-share scheduling
+    Priority int // higher goes first within a tenant and is shed last
+    Placement Placement // which nodes may run the task
+    Pool string // which pool's nodes, DefaultPool if ""
+
+    // resubmitting with the key of a task submitted less than
+    // IdempotencyWindow ago follows that task instead of starting another
+    IdempotencyKey string
+
+    Trace TraceContext // parent of the task's spans, if it's part of a bigger trace
+}
+
+// a submitted task. Checkpoints yields progressive results and is closed when
+// the task ends. Cancel cancels it, like Server.CancelTask
+// the task never waits for Checkpoints to be read: a reader which falls
+// behind skips to the latest checkpoint, but always gets the final one
+type Submission struct {
+    Id int
+    Checkpoints chan Task
+    Trace TraceContext // the task's root span
+
+    server *Server
+    rec *taskRecord
 }
 
 type Client struct {
     Version int
     ServerDomain string
     ServerPort int
+    ServerAddrs []string // more servers ("host:port") to fail over to, in order
+
+    // UDP address to listen for server announcements on, e.g. the multicast
+    // group servers Announce on. servers found this way are tried after any
+    // configured ones, skipping those with a different Version
+    Discover string
     Caps ClientCaps
 
+    // file to keep Caps.Identity in, generated on first run. leave it empty
+    // to set Caps.Identity yourself, e.g. from a certificate, or not at all
+    IdentityFile string
+
+    // run each task in a child process instead of a goroutine.
+    // the program must call RunIsolatedChild() at the top of main()
+    Isolate bool
+    TaskMemLimitMB int // 0 means unlimited
+    TaskCpuTime time.Duration // total cpu time, 0 means unlimited
+    TaskCpus int // cpu bandwidth, only enforced with cgroups v2
+
+    // when no server answers, retry after RetryBackoff (default 1s), doubling
+    // up to MaxRetryBackoff (default 1m). the current task keeps running
+    RetryBackoff time.Duration
+    MaxRetryBackoff time.Duration
+    GiveUpAfter time.Duration // Run returns after this long without a server, 0 never
+    Heartbeat time.Duration // how often to check in with nothing to report, default 30s
+
+    Logger *slog.Logger // defaults to slog.Default()
+    SpanExporter SpanExporter // nil to drop spans
+    Chaos *Chaos // faults to inject, for testing. nil for none
+
     running bool
+    log *slog.Logger
+    trace TraceContext // run span of the current task, sent with every sync
+    meter *taskMeter // of the current task
+    usage ResourceUsage // sent with the next sync
+    dispatchTrace TraceContext // from the last SyncResponse
 
     serverId int
+    term int // the highest SyncResponse.Term seen from serverId
+    server string // the one of addrs() we're talking to, "" for the first
+    discovery *discovery
     netClient http.Client
 }
 
+// the final checkpoint of a task which crashed on its node
+// Last is the last successful checkpoint, or the original task
+type TaskFailed struct {
+    Reason string
+    Last Task
+}
+
+func (self TaskFailed) IsDone() bool {
+    return true
+}
+
+func (self TaskFailed) Run(progress chan Task, cancel chan bool) {
+    <-cancel
+}
+
+// task types by name, for submitting tasks described in json
+var taskTypesLock sync.Mutex
+var taskTypes = make(map[string]reflect.Type)
+
 func RegisterTaskType(value Task) {
     gob.Register(value)
+
+    taskTypesLock.Lock()
+    taskTypes[reflect.TypeOf(value).String()] = reflect.TypeOf(value)
+    taskTypesLock.Unlock()
 }
@@ -0,0 +1,211 @@
+package silk
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+    "strconv"
+    "encoding/csv"
+)
+
+// resources used by a task, over one checkpoint interval or summed over many.
+// for tasks which aren't isolated Cpu and PeakRSSKB are those of the whole
+// client process, which runs one task at a time. the client's peak rss is
+// reset when each task starts, so it's the task's own plus what the client
+// itself needs. where it can't be reset PeakRSSKB is 0, for unknown
+type ResourceUsage struct {
+    Cpu time.Duration // user plus system
+    Wall time.Duration
+    PeakRSSKB int64 // the highest of any one interval, 0 if unknown
+    Reports int // checkpoints and failures this adds up
+}
+
+func (self *ResourceUsage) add(other ResourceUsage) {
+    self.Cpu += other.Cpu
+    self.Wall += other.Wall
+    if other.PeakRSSKB > self.PeakRSSKB {
+        self.PeakRSSKB = other.PeakRSSKB
+    }
+    self.Reports += other.Reports
+}
+
+// one line of a usage report. Key is a task id, tenant or node id
+type UsageRow struct {
+    Key string
+    ResourceUsage
+}
+
+// measures the task a client is running
+type taskMeter struct {
+    lock sync.Mutex
+    start time.Time
+    base ResourceUsage // our own process's, when the task started
+    isolated bool
+    pid int // of the isolated child, 0 until it's started
+    final *ResourceUsage // the child's, once it's exited
+    peak int64 // the child's highest rss seen so far
+    peakUnknown bool // our own peak couldn't be reset for the task
+    last ResourceUsage // totals as of the last report
+}
+
+func newTaskMeter(isolated bool) *taskMeter {
+    peakUnknown := !isolated && !resetPeakRSS()
+    base, _ := processUsage(0)
+    return &taskMeter{start: time.Now(), base: base, isolated: isolated, peakUnknown: peakUnknown}
+}
+
+// the task is running in child process pid from now on
+func (self *taskMeter) child(pid int) {
+    self.lock.Lock()
+    self.pid = pid
+    self.lock.Unlock()
+}
+
+func (self *taskMeter) exited(state *os.ProcessState) {
+    if state == nil {
+        return
+    }
+    final := exitedUsage(state)
+
+    self.lock.Lock()
+    if final.PeakRSSKB < self.peak {
+        final.PeakRSSKB = self.peak
+    }
+    self.final = &final
+    self.lock.Unlock()
+}
+
+// must hold lock. everything the task has used so far
+func (self *taskMeter) total() ResourceUsage {
+    var total ResourceUsage
+    switch {
+    case self.final != nil:
+        total = *self.final
+    case self.pid != 0:
+        total, _ = processUsage(self.pid)
+        if total.PeakRSSKB > self.peak {
+            self.peak = total.PeakRSSKB
+        }
+        total.PeakRSSKB = self.peak
+    case self.isolated:
+        // not started yet
+    default:
+        total, _ = processUsage(0)
+        total.Cpu -= self.base.Cpu
+        if self.peakUnknown {
+            total.PeakRSSKB = 0
+        }
+    }
+    total.Wall = time.Since(self.start)
+    return total
+}
+
+// usage since the last report, and the totals to pass to reported once the
+// report went through. a nil meter measures nothing
+func (self *taskMeter) unreported() (ResourceUsage, ResourceUsage) {
+    if self == nil {
+        return ResourceUsage{}, ResourceUsage{}
+    }
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    total := self.total()
+    interval := ResourceUsage{
+        Cpu: total.Cpu - self.last.Cpu,
+        Wall: total.Wall - self.last.Wall,
+        PeakRSSKB: total.PeakRSSKB,
+        Reports: 1,
+    }
+    return interval, total
+}
+
+func (self *taskMeter) reported(total ResourceUsage) {
+    if self == nil {
+        return
+    }
+
+    self.lock.Lock()
+    self.last = total
+    self.lock.Unlock()
+}
+
+// must hold taskLock. a node reported on rec, having used usage since its
+// last report
+func (self *Server) taskUsed(rec *taskRecord, usage ResourceUsage) {
+    if usage.Reports == 0 {
+        // from a client which doesn't measure
+        return
+    }
+    rec.status.Usage.add(usage)
+
+    tenant, ok := self.tenantResources[rec.status.Tenant]
+    if !ok {
+        tenant = &ResourceUsage{}
+        self.tenantResources[rec.status.Tenant] = tenant
+    }
+    tenant.add(usage)
+
+    node, ok := self.nodeResources[rec.status.NodeId]
+    if !ok {
+        node = &ResourceUsage{}
+        self.nodeResources[rec.status.NodeId] = node
+    }
+    node.add(usage)
+}
+
+// resources used, by "task", "tenant" or "node". tasks are those Tasks()
+// still lists, tenants and nodes are since the server started
+func (self *Server) Usage(by string) ([]UsageRow, error) {
+    var result []UsageRow
+
+    self.taskLock.Lock()
+    switch by {
+    case "task":
+        for id, rec := range self.tasks {
+            result = append(result, UsageRow{strconv.Itoa(id), rec.status.Usage})
+        }
+    case "tenant":
+        for tenant, usage := range self.tenantResources {
+            result = append(result, UsageRow{tenant, *usage})
+        }
+    case "node":
+        for id, usage := range self.nodeResources {
+            result = append(result, UsageRow{strconv.Itoa(id), *usage})
+        }
+    default:
+        self.taskLock.Unlock()
+        return nil, fmt.Errorf("can't break usage down by %q", by)
+    }
+    self.taskLock.Unlock()
+
+    sort.Slice(result, func(i, j int) bool {
+        a, aErr := strconv.Atoi(result[i].Key)
+        b, bErr := strconv.Atoi(result[j].Key)
+        if aErr == nil && bErr == nil {
+            return a < b
+        }
+        return result[i].Key < result[j].Key
+    })
+    return result, nil
+}
+
+// write rows as csv, with a header line. by names the key column
+func WriteUsageCsv(w io.Writer, by string, rows []UsageRow) error {
+    out := csv.NewWriter(w)
+    out.Write([]string{by, "cpu_seconds", "wall_seconds", "peak_rss_kb", "reports"})
+    for _, row := range rows {
+        out.Write([]string{
+            row.Key,
+            strconv.FormatFloat(row.Cpu.Seconds(), 'f', 3, 64),
+            strconv.FormatFloat(row.Wall.Seconds(), 'f', 3, 64),
+            strconv.FormatInt(row.PeakRSSKB, 10),
+            strconv.Itoa(row.Reports),
+        })
+    }
+    out.Flush()
+    return out.Error()
+}
@@ -0,0 +1,75 @@
+package silk
+
+import (
+    "os"
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "syscall"
+    "io/ioutil"
+)
+
+// /proc/PID/stat counts cpu time in these, which is 100 on every linux
+// we'd run on
+const clockTicks = 100
+
+// cpu time and peak rss so far of process pid, or of our own process if pid
+// is 0. our own peak is since resetPeakRSS. Wall is left to the caller
+func processUsage(pid int) (ResourceUsage, bool) {
+    if pid == 0 {
+        var ru syscall.Rusage
+        err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+        if err != nil {
+            return ResourceUsage{}, false
+        }
+        return ResourceUsage{Cpu: time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), PeakRSSKB: peakRSS("self")}, true
+    }
+
+    stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+    if err != nil {
+        return ResourceUsage{}, false
+    }
+    // the command name may have spaces in it, so count fields from after it
+    fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")") + 1:]))
+    if len(fields) < 13 {
+        return ResourceUsage{}, false
+    }
+    utime, _ := strconv.ParseInt(fields[11], 10, 64)
+    stime, _ := strconv.ParseInt(fields[12], 10, 64)
+    return ResourceUsage{Cpu: time.Duration(utime + stime) * time.Second / clockTicks, PeakRSSKB: peakRSS(strconv.Itoa(pid))}, true
+}
+
+// VmHWM of /proc/PID, 0 if it can't be read
+func peakRSS(pid string) int64 {
+    status, err := ioutil.ReadFile("/proc/" + pid + "/status")
+    if err != nil {
+        return 0
+    }
+    for _, line := range strings.Split(string(status), "\n") {
+        if strings.HasPrefix(line, "VmHWM:") {
+            fields := strings.Fields(line)
+            if len(fields) >= 2 {
+                peak, _ := strconv.ParseInt(fields[1], 10, 64)
+                return peak
+            }
+        }
+    }
+    return 0
+}
+
+// bring our own peak rss down to what we're using now, so the peak of a task
+// which isn't isolated isn't that of some earlier, bigger task. false if the
+// kernel won't, in which case the peak is unknown
+func resetPeakRSS() bool {
+    return ioutil.WriteFile("/proc/self/clear_refs", []byte("5"), 0) == nil
+}
+
+// what an isolated child used, all told
+func exitedUsage(state *os.ProcessState) ResourceUsage {
+    usage := ResourceUsage{Cpu: state.UserTime() + state.SystemTime()}
+    if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+        usage.PeakRSSKB = ru.Maxrss
+    }
+    return usage
+}
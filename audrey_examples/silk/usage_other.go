@@ -0,0 +1,20 @@
+//go:build !linux
+
+package silk
+
+import (
+    "os"
+)
+
+// only wall time is measured off linux
+func processUsage(pid int) (ResourceUsage, bool) {
+    return ResourceUsage{}, false
+}
+
+func resetPeakRSS() bool {
+    return false
+}
+
+func exitedUsage(state *os.ProcessState) ResourceUsage {
+    return ResourceUsage{Cpu: state.UserTime() + state.SystemTime()}
+}
@@ -11,6 +11,7 @@ for IMAGE in $IMAGES; do
     if [[ $BENCHMARK == "bin" ]]; then continue; fi
     if [[ $BENCHMARK == "cpu_bound" ]]; then continue; fi
     if [[ $BENCHMARK == "example" ]]; then continue; fi
+    if [[ $BENCHMARK == silk_* ]]; then continue; fi # needs the silk package and a newer go
     for GOOS in $SYSTEMS; do
       if [[ $IMAGE == gcc* && $GOOS != "linux" ]]; then
 	continue
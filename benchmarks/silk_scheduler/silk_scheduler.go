@@ -0,0 +1,228 @@
+//A benchmark for the bookkeeping cost of the silk scheduler core. Submits
+//tasks to a server and has nodes join and sync by calling its /sync handler
+//directly, with no network, and measures the memory, goroutines and CPU time
+//each task, node and sync costs, plus what the server burns while idle
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rhelmot/golang-concurrency-supercool/audrey_examples/silk"
+)
+
+var tasks_flag = flag.String("tasks", "1000,10000,100000", "numbers of tasks to try, comma separated (default 1000,10000,100000)")
+var nodes_flag = flag.Int("nodes", 1000, "nodes to join, each takes one of the tasks (default 1000)")
+var syncs_flag = flag.Int("syncs", 10, "heartbeats each node sends (default 10)")
+var idle_flag = flag.Duration("idle", 2*time.Second, "how long to watch the server sit idle (default 2s)")
+
+//Never run, the nodes here only pretend
+type Noop struct {
+	N int
+}
+
+func (self Noop) IsDone() bool {
+	return false
+}
+
+func (self Noop) Run(progress chan silk.Task, cancel chan bool) {
+	<-cancel
+}
+
+//What goes on the wire after a SyncRequest or SyncResponse
+type wireTask struct {
+	TaskId int
+	Task   silk.Task
+}
+
+//How much of everything the process is using
+type sample struct {
+	cpu        time.Duration
+	memory     uint64
+	goroutines int
+}
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func memory() uint64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return mem.HeapInuse + mem.StackInuse
+}
+
+//Before something is measured. The heap is collected first, so garbage left
+//over from before doesn't count
+func measureBefore() sample {
+	runtime.GC()
+	return sample{cpuTime(), memory(), runtime.NumGoroutine()}
+}
+
+//After something is measured. The CPU time is read before the heap is
+//collected, so collecting it doesn't count either
+func measureAfter() sample {
+	cpu := cpuTime()
+	runtime.GC()
+	return sample{cpu, memory(), runtime.NumGoroutine()}
+}
+
+//Prints what changed between before and after, per n of unit
+func report(what string, unit string, n int, before sample, after sample) {
+	fmt.Printf("  %s: %v cpu, %d bytes, %.2f goroutines per %s\n", what,
+		((after.cpu-before.cpu)/time.Duration(n)).Round(10*time.Nanosecond),
+		(int64(after.memory)-int64(before.memory))/int64(n),
+		float64(after.goroutines-before.goroutines)/float64(n), unit)
+}
+
+func main() {
+	flag.Parse()
+	silk.RegisterTaskType(Noop{})
+
+	var counts []int
+	for _, s := range strings.Split(*tasks_flag, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			log.Fatal("bad number of tasks: ", err)
+		}
+		counts = append(counts, n)
+	}
+
+	for _, n := range counts {
+		fmt.Fprintf(os.Stderr, "Testing %d tasks\n", n)
+		runWithProfile(n)
+	}
+}
+
+func runWithProfile(n int) {
+	f, err := os.Create("silk_scheduler-" + strconv.Itoa(n) + "-tasks.pprof")
+	if err != nil {
+		log.Fatal("could not create CPU profile: ", err)
+	}
+	defer f.Close()
+	if err := pprof.StartCPUProfile(f); err != nil {
+		log.Fatal("could not start CPU profile: ", err)
+	}
+	defer pprof.StopCPUProfile()
+
+	run(n)
+}
+
+//Sends one sync to the server and returns its reply
+func post(server *silk.Server, req silk.SyncRequest, task *wireTask) (silk.SyncResponse, wireTask) {
+	var body bytes.Buffer
+	e := gob.NewEncoder(&body)
+	if err := e.Encode(&req); err != nil {
+		log.Fatal("could not encode SyncRequest: ", err)
+	}
+	if task != nil {
+		if err := e.Encode(task); err != nil {
+			log.Fatal("could not encode task: ", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/sync", &body))
+	if w.Code != 200 {
+		log.Fatal("sync failed: ", w.Code, " ", w.Body.String())
+	}
+
+	var resp silk.SyncResponse
+	var sent wireTask
+	d := gob.NewDecoder(w.Body)
+	if err := d.Decode(&resp); err != nil {
+		log.Fatal("could not decode SyncResponse: ", err)
+	}
+	if err := d.Decode(&sent); err != nil {
+		log.Fatal("could not decode task: ", err)
+	}
+	return resp, sent
+}
+
+func run(n int) {
+	fmt.Printf("%d tasks, %d nodes\n", n, *nodes_flag)
+
+	server := &silk.Server{
+		Version:     1,
+		Listen:      "127.0.0.1:0", // unused, syncs are handed to ServeHTTP
+		NodeTimeout: time.Hour,
+		Logger:      slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})),
+		MaxResults:  1, // the results of cancelled tasks aren't what's being measured
+	}
+	joined, remembered := server.Serve()
+	go func() {
+		for range joined {
+		}
+	}()
+	go func() {
+		for range remembered {
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	//Nobody reads the checkpoints, as with tasks submitted over http
+	ids := make([]int, n)
+	before := measureBefore()
+	for i := range ids {
+		sub, err := server.SubmitTaskWith(Noop{i}, silk.TaskOptions{})
+		if err != nil {
+			log.Fatal("could not submit: ", err)
+		}
+		ids[i] = sub.Id
+	}
+	after := measureAfter()
+	report("submit", "task", n, before, after)
+
+	nodes := *nodes_flag
+	if nodes > n {
+		nodes = n
+	}
+	reqs := make([]silk.SyncRequest, nodes)
+	running := make([]int, nodes)
+	before = measureBefore()
+	for i := range reqs {
+		reqs[i] = silk.SyncRequest{Version: 1, Caps: silk.ClientCaps{NodeId: -1}}
+		resp, sent := post(server, reqs[i], nil)
+		reqs[i].Caps.NodeId = resp.NodeId
+		reqs[i].ServerId = resp.ServerId
+		running[i] = sent.TaskId
+	}
+	after = measureAfter()
+	report("join", "node", nodes, before, after)
+
+	before = measureBefore()
+	for round := 0; round < *syncs_flag; round++ {
+		for i := range reqs {
+			post(server, reqs[i], &wireTask{running[i], nil})
+		}
+	}
+	after = measureAfter()
+	report("heartbeat", "sync", nodes * *syncs_flag, before, after)
+
+	before = measureBefore()
+	time.Sleep(*idle_flag)
+	after = measureAfter()
+	fmt.Printf("  idle: %.2f%% of a cpu\n", 100*float64(after.cpu-before.cpu)/float64(*idle_flag))
+
+	before = measureBefore()
+	for _, id := range ids {
+		server.CancelTask(id)
+	}
+	after = measureAfter()
+	report("cancel", "task", n, before, after)
+}
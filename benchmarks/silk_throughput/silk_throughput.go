@@ -0,0 +1,373 @@
+//A benchmark for the silk task scheduler. Runs a server and simulated nodes
+//in one process over loopback, measures dispatch latency, throughput and
+//sync overhead, then kills some nodes mid-task and measures how long their
+//tasks take to run again elsewhere, for each node timeout
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rhelmot/golang-concurrency-supercool/audrey_examples/silk"
+)
+
+var nodes_flag = flag.Int("nodes", 20, "simulated nodes (default 20)")
+var tasks_flag = flag.Int("tasks", 500, "tasks to push through the nodes for throughput (default 500)")
+var steps_flag = flag.Int("steps", 5, "checkpoints per task (default 5)")
+var step_ms_flag = flag.Int("step_ms", 10, "work between checkpoints in ms (default 10)")
+var payload_kb_flag = flag.Int("payload_kb", 1, "size of every task and checkpoint in KB (default 1)")
+var heartbeat_ms_flag = flag.Int("heartbeat_ms", 100, "how often idle nodes check in, in ms (default 100)")
+var kill_flag = flag.Int("kill", 4, "extra nodes to kill mid-task to measure rescheduling (default 4)")
+var node_timeouts_flag = flag.String("node_timeouts", "500ms,1s,2s", "server NodeTimeouts to try, comma separated (default 500ms,1s,2s)")
+var verbose_flag = flag.Bool("v", false, "log what the server and nodes get up to")
+
+//How long the tasks on the nodes which get killed run for. Long enough that
+//they're still running when their nodes are killed
+const failoverTaskMs = 2000
+
+//Sleeps StepMs between checkpoints, carrying Payload along with every one
+type Work struct {
+	Seq     int
+	Step    int
+	Steps   int
+	StepMs  int
+	Payload []byte
+}
+
+func (self Work) IsDone() bool {
+	return self.Step >= self.Steps
+}
+
+func (self Work) Run(progress chan silk.Task, cancel chan bool) {
+	started(self.Seq)
+	for !self.IsDone() {
+		select {
+		case <-cancel:
+			return
+		case <-time.After(time.Duration(self.StepMs) * time.Millisecond):
+		}
+		self.Step++
+		progress <- self
+	}
+	<-cancel
+}
+
+//When each task started running on a node, every time it did. The nodes
+//run in this process, so this is when the node actually got it
+var startsLock sync.Mutex
+var starts = make(map[int][]time.Time)
+
+//Numbers tasks across runs, so they don't mix in starts
+var seq = 0
+
+func started(seq int) {
+	startsLock.Lock()
+	starts[seq] = append(starts[seq], time.Now())
+	startsLock.Unlock()
+}
+
+func startsOf(seq int) []time.Time {
+	startsLock.Lock()
+	defer startsLock.Unlock()
+	return append([]time.Time{}, starts[seq]...)
+}
+
+//Passes /sync on to the server, counting requests and the time it takes.
+//Every node gets its own listener in front of it, so a node can be killed
+//by closing its listener
+type syncCounter struct {
+	server *silk.Server
+	count  int64
+	nanos  int64
+	bytes  int64
+}
+
+func (self *syncCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	self.server.ServeHTTP(w, r)
+	atomic.AddInt64(&self.nanos, int64(time.Since(start)))
+	atomic.AddInt64(&self.count, 1)
+	if r.ContentLength > 0 {
+		atomic.AddInt64(&self.bytes, r.ContentLength)
+	}
+}
+
+func (self *syncCounter) reset() (int64, int64, int64) {
+	return atomic.SwapInt64(&self.count, 0), atomic.SwapInt64(&self.nanos, 0), atomic.SwapInt64(&self.bytes, 0)
+}
+
+type result struct {
+	timeout    time.Duration
+	elapsed    time.Duration
+	dispatch   []time.Duration
+	syncs      int64
+	syncNanos  int64
+	syncBytes  int64
+	detect     []time.Duration
+	redispatch []time.Duration
+}
+
+func main() {
+	flag.Parse()
+	silk.RegisterTaskType(Work{})
+
+	var timeouts []time.Duration
+	for _, s := range strings.Split(*node_timeouts_flag, ",") {
+		timeout, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			log.Fatal("bad node timeout: ", err)
+		}
+		timeouts = append(timeouts, timeout)
+	}
+
+	level := slog.LevelError + 1
+	if *verbose_flag {
+		level = slog.LevelInfo
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	fmt.Printf("%d nodes, %d tasks of %d x %dms, %dKB payload, heartbeat %dms, %d nodes killed\n",
+		*nodes_flag, *tasks_flag, *steps_flag, *step_ms_flag, *payload_kb_flag, *heartbeat_ms_flag, *kill_flag)
+	for _, timeout := range timeouts {
+		fmt.Fprintf(os.Stderr, "Testing node timeout %v\n", timeout)
+		runtime.GC()
+		report(runWithProfile(timeout, logger))
+	}
+}
+
+func runWithProfile(timeout time.Duration, logger *slog.Logger) result {
+	f, err := os.Create("silk_throughput-" + timeout.String() + ".pprof")
+	if err != nil {
+		log.Fatal("could not create CPU profile: ", err)
+	}
+	defer f.Close()
+	if err := pprof.StartCPUProfile(f); err != nil {
+		log.Fatal("could not start CPU profile: ", err)
+	}
+	defer pprof.StopCPUProfile()
+
+	return run(timeout, logger)
+}
+
+//A node talking to the server through a listener of its own. Closing the
+//returned server kills it as far as the silk server can tell
+func startNode(counter *syncCounter, timeout time.Duration, logger *slog.Logger) *http.Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal("could not listen for a node: ", err)
+	}
+	srv := &http.Server{Handler: counter}
+	go srv.Serve(listener)
+
+	client := &silk.Client{
+		Version:         1,
+		ServerDomain:    "127.0.0.1",
+		ServerPort:      listener.Addr().(*net.TCPAddr).Port,
+		Heartbeat:       time.Duration(*heartbeat_ms_flag) * time.Millisecond,
+		RetryBackoff:    50 * time.Millisecond,
+		MaxRetryBackoff: 500 * time.Millisecond,
+		GiveUpAfter:     2 * timeout, // so killed nodes don't pile up across runs
+		Logger:          logger,
+	}
+	go client.Run()
+	return srv
+}
+
+func waitForNodes(server *silk.Server, n int) {
+	for len(server.Nodes()) < n {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitForStarts(seq int, n int, deadline time.Time) bool {
+	for len(startsOf(seq)) < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func run(timeout time.Duration, logger *slog.Logger) result {
+	res := result{timeout: timeout}
+
+	server := &silk.Server{
+		Version:         1,
+		Listen:          "127.0.0.1:0", // unused, the nodes go through their own listeners
+		NodeTimeout:     timeout,
+		Logger:          logger,
+		QuarantineScore: 1e9, // every node is on the same host, the killed ones would get it quarantined
+	}
+	joined, remembered := server.Serve()
+	go func() {
+		for range joined {
+		}
+	}()
+	go func() {
+		for range remembered {
+		}
+	}()
+
+	counter := &syncCounter{server: server}
+	payload := make([]byte, *payload_kb_flag*1024)
+	var nodes []*http.Server
+
+	//Failover: the doomed nodes join first and take one long task each. The
+	//rest join once they're busy, so they're idle when the doomed ones die
+	kill := *kill_flag
+	if kill > 0 {
+		var victims []*http.Server
+		for i := 0; i < kill; i++ {
+			victims = append(victims, startNode(counter, timeout, logger))
+		}
+		waitForNodes(server, kill)
+
+		var failover []int
+		var subs []*silk.Submission
+		for i := 0; i < kill; i++ {
+			seq++
+			sub, err := server.SubmitTaskWith(Work{seq, 0, *steps_flag, failoverTaskMs / *steps_flag, payload}, silk.TaskOptions{})
+			if err != nil {
+				log.Fatal("could not submit: ", err)
+			}
+			failover = append(failover, seq)
+			subs = append(subs, sub)
+		}
+		for _, s := range failover {
+			waitForStarts(s, 1, time.Now().Add(time.Minute))
+		}
+
+		for i := 0; i < *nodes_flag; i++ {
+			nodes = append(nodes, startNode(counter, timeout, logger))
+		}
+		waitForNodes(server, kill+*nodes_flag)
+
+		_, live, done := server.Events()
+		timedOut := make(chan time.Time, kill)
+		go func() {
+			for event := range live {
+				if event.Kind == silk.EventNodeTimeout {
+					timedOut <- event.Time
+				}
+			}
+		}()
+
+		killed := time.Now()
+		for _, victim := range victims {
+			victim.Close()
+		}
+
+		deadline := killed.Add(2*timeout + time.Minute)
+		for _, s := range failover {
+			if !waitForStarts(s, 2, deadline) {
+				fmt.Fprintf(os.Stderr, "Task %d never ran again\n", s)
+				continue
+			}
+			res.redispatch = append(res.redispatch, startsOf(s)[1].Sub(killed))
+		}
+		for len(res.detect) < kill && time.Now().Before(deadline) {
+			select {
+			case at := <-timedOut:
+				res.detect = append(res.detect, at.Sub(killed))
+			case <-time.After(time.Until(deadline)):
+			}
+		}
+		done()
+
+		for _, sub := range subs {
+			for range sub.Checkpoints {
+			}
+		}
+	} else {
+		for i := 0; i < *nodes_flag; i++ {
+			nodes = append(nodes, startNode(counter, timeout, logger))
+		}
+		waitForNodes(server, *nodes_flag)
+	}
+
+	//Throughput: everything at once, with the nodes pulling as fast as they can
+	counter.reset()
+	var wg sync.WaitGroup
+	submitted := make(map[int]time.Time)
+	begin := time.Now()
+	for i := 0; i < *tasks_flag; i++ {
+		seq++
+		submitted[seq] = time.Now()
+		sub, err := server.SubmitTaskWith(Work{seq, 0, *steps_flag, *step_ms_flag, payload}, silk.TaskOptions{})
+		if err != nil {
+			log.Fatal("could not submit: ", err)
+		}
+		wg.Add(1)
+		go func(sub *silk.Submission) {
+			for range sub.Checkpoints {
+			}
+			wg.Done()
+		}(sub)
+	}
+	wg.Wait()
+	res.elapsed = time.Since(begin)
+	res.syncs, res.syncNanos, res.syncBytes = counter.reset()
+
+	for s, at := range submitted {
+		if times := startsOf(s); len(times) > 0 {
+			res.dispatch = append(res.dispatch, times[0].Sub(at))
+		}
+	}
+
+	for _, node := range nodes {
+		node.Close()
+	}
+	return res
+}
+
+func report(res result) {
+	tasks := float64(*tasks_flag)
+	fmt.Println("node timeout", res.timeout)
+	fmt.Printf("  throughput: %.1f tasks/s (%v for %d tasks)\n", tasks/res.elapsed.Seconds(), res.elapsed.Round(time.Millisecond), *tasks_flag)
+	fmt.Printf("  dispatch latency: p50 %v, p99 %v, max %v\n",
+		percentile(res.dispatch, 0.5), percentile(res.dispatch, 0.99), percentile(res.dispatch, 1))
+	if res.syncs > 0 {
+		fmt.Printf("  sync overhead: %.1f syncs/task, %v per sync, %.1fKB per sync\n",
+			float64(res.syncs)/tasks, time.Duration(res.syncNanos/res.syncs), float64(res.syncBytes)/float64(res.syncs)/1024)
+	}
+	if *kill_flag > 0 {
+		fmt.Printf("  after killing %d nodes: timed out in %v (mean), tasks running again in %v (mean), %v (max)\n",
+			*kill_flag, mean(res.detect), mean(res.redispatch), percentile(res.redispatch, 1))
+	}
+}
+
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, samples...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted[int(p*float64(len(sorted)-1))].Round(time.Microsecond)
+}
+
+func mean(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, sample := range samples {
+		total += sample
+	}
+	return (total / time.Duration(len(samples))).Round(time.Millisecond)
+}